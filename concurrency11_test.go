@@ -1,14 +1,31 @@
 package main
 
 import (
+	"container/heap"
 	"container/list"
+	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // 设计一个并发安全的LRU缓存，支持并发读写操作，并在测试中验证其正确性和性能。
+//
+// Get命中时需要把元素移动到链表头部，会修改链表，所以和Put一样必须持有写锁；
+// 持有读锁时多个Get会同时修改链表，是数据竞争。读多写少、需要更高吞吐量时使用concurrency33中的ShardedLRUCache
+//
+// LRUCache支持任意可比较类型的key和任意类型的value，每个元素可以设置过期时间：
+// 访问时发现过期的元素会被删除，另外可以启动后台goroutine定期清理；超过容量时先删除过期的元素，再淘汰最久未使用的元素
+//
+// SetOnEvict设置元素被移除时的回调（例如把脏数据写回、关闭资源），回调在释放锁之后执行，可以在回调中访问缓存
+// Stats返回命中、未命中、淘汰和过期的次数，用来根据命中率调整容量
+//
+// 除了限制元素数量，还可以按成本（例如字节数）限制容量：每个元素的成本由Sizer计算或者在PutWithCost时指定，默认为1，
+// 总成本超过maxCost时淘汰最久未使用的元素，成本本身就超过maxCost的元素会被拒绝
 func TestConcurrency11(t *testing.T) {
-	lru := NewLRUCache(3)
+	lru := NewLRUCache[int, int](3)
 	var wg sync.WaitGroup
 	wg.Add(6)
 	go func() {
@@ -49,51 +66,889 @@ func TestConcurrency11(t *testing.T) {
 
 }
 
-type LRUCache struct {
-	capacity int
-	cache    map[int]*list.Element
-	mu       sync.RWMutex
-	lrulist  *list.List
+type LRUCache[K comparable, V any] struct {
+	capacity    int
+	defaultTTL  time.Duration
+	cache       map[K]*list.Element
+	mu          sync.RWMutex
+	lrulist     *list.List
+	expiry      expiryHeap[K, V] // 设置了过期时间的元素，按过期时间排序
+	now         func() time.Time
+	stop        chan struct{}
+	stopOnce    sync.Once
+	onEvict     func(key K, value V, reason EvictReason)
+	evicted     []eviction[K, V] // 持有锁期间被移除的元素，释放锁之后交给onEvict
+	stats       CacheStats
+	costLimited bool // NewLRUCacheWithCost创建的缓存按maxCost限制总成本
+	maxCost     int64
+	cost        int64
+	sizer       func(key K, value V) int64
 }
 
-func NewLRUCache(capacity int) *LRUCache {
-	lruCache := &LRUCache{
+// EvictReason 表示元素被移除的原因
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota // 超过容量被淘汰
+	EvictExpired                     // 过期
+	EvictDeleted                     // 调用Delete或Purge删除
+	EvictRejected                    // 新的值被拒绝写入，原来的值随之删除
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDeleted:
+		return "deleted"
+	case EvictRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+type eviction[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictReason
+}
+
+// CacheStats 是缓存的统计信息，Peek不计入命中和未命中
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // 超过容量被淘汰的元素数量
+	Expirations uint64 // 过期被删除的元素数量
+	Rejected    uint64 // 成本为负数或者超过maxCost被拒绝写入的元素数量
+	Cost        int64  // 当前所有元素的总成本
+}
+
+// HitRatio 返回命中率，没有任何访问时返回0
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func NewLRUCache[K comparable, V any](capacity int) *LRUCache[K, V] {
+	lruCache := &LRUCache[K, V]{
 		capacity: capacity,
-		cache:    make(map[int]*list.Element),
+		cache:    make(map[K]*list.Element),
 		lrulist:  list.New(), // list的作用在于删除最久未使用的元素
+		now:      time.Now,
+		stop:     make(chan struct{}),
 	}
 	return lruCache
 }
 
-type Entry struct {
-	key   int
-	value int
+// NewLRUCacheWithTTL 创建带过期时间的LRU缓存，Put写入的元素在defaultTTL之后过期，defaultTTL<=0表示不过期
+// cleanupInterval>0时启动一个后台goroutine定期清理过期的元素，不再使用时需要调用Stop
+func NewLRUCacheWithTTL[K comparable, V any](capacity int, defaultTTL, cleanupInterval time.Duration) *LRUCache[K, V] {
+	lruCache := NewLRUCache[K, V](capacity)
+	lruCache.defaultTTL = defaultTTL
+	if cleanupInterval > 0 {
+		go lruCache.janitor(cleanupInterval)
+	}
+	return lruCache
+}
+
+// NewLRUCacheWithCost 创建按成本限制容量的LRU缓存，不限制元素数量，sizer为nil时每个元素的成本为1
+// maxCost<=0时按0处理，所有成本大于0的元素都会被拒绝，和参数不合法的限流器一样宁可拒绝也不悄悄地不限制
+func NewLRUCacheWithCost[K comparable, V any](maxCost int64, sizer func(key K, value V) int64) *LRUCache[K, V] {
+	lruCache := NewLRUCache[K, V](math.MaxInt)
+	lruCache.costLimited = true
+	lruCache.maxCost = max(maxCost, 0)
+	lruCache.sizer = sizer
+	return lruCache
+}
+
+type Entry[K comparable, V any] struct {
+	key      K
+	value    V
+	cost     int64
+	expireAt time.Time // 零值表示不过期
+	index    int       // 在expiry堆中的下标，-1表示不在堆中
+}
+
+func (e *Entry[K, V]) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+type expiryHeap[K comparable, V any] []*Entry[K, V]
+
+func (h expiryHeap[K, V]) Len() int           { return len(h) }
+func (h expiryHeap[K, V]) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *expiryHeap[K, V]) Push(x any) {
+	e := x.(*Entry[K, V])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *expiryHeap[K, V]) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// Get 获取元素并把它标记为最近使用，过期的元素会被删除
+func (lru *LRUCache[K, V]) Get(key K) (V, bool) {
+	value, _, ok := lru.getWithExpiry(key)
+	return value, ok
 }
 
-func (lru *LRUCache) Get(key int) (int, bool) {
+// getWithExpiry 和Get一样，另外返回元素的过期时间，零值表示不过期
+func (lru *LRUCache[K, V]) getWithExpiry(key K) (V, time.Time, bool) {
+	lru.mu.Lock()
+	defer lru.unlock()
+
+	if elem, ok := lru.cache[key]; ok {
+		entry := elem.Value.(*Entry[K, V])
+		if !entry.expired(lru.now()) {
+			lru.stats.Hits++
+			lru.lrulist.MoveToFront(elem)
+			return entry.value, entry.expireAt, true
+		}
+		lru.removeElementLocked(elem, EvictExpired)
+	}
+	lru.stats.Misses++
+	var zero V
+	return zero, time.Time{}, false
+}
+
+// Peek 获取元素但不改变它的使用顺序
+func (lru *LRUCache[K, V]) Peek(key K) (V, bool) {
 	lru.mu.RLock()
 	defer lru.mu.RUnlock()
 
 	if elem, ok := lru.cache[key]; ok {
-		lru.lrulist.MoveToFront(elem)
-		return elem.Value.(*Entry).value, true
+		if entry := elem.Value.(*Entry[K, V]); !entry.expired(lru.now()) {
+			return entry.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Put 写入元素，过期时间为defaultTTL
+func (lru *LRUCache[K, V]) Put(key K, value V) {
+	lru.PutWithTTL(key, value, lru.defaultTTL)
+}
+
+// PutWithTTL 写入元素并指定过期时间，ttl<=0表示不过期
+func (lru *LRUCache[K, V]) PutWithTTL(key K, value V, ttl time.Duration) {
+	cost := int64(1)
+	if lru.sizer != nil {
+		cost = lru.sizer(key, value)
 	}
-	return 0, false
+	lru.PutWithCost(key, value, cost, ttl)
 }
-func (lru *LRUCache) Put(key int, value int) {
+
+// PutWithCost 写入元素并指定成本和过期时间，成本为负数或者超过maxCost时拒绝写入并返回false，
+// key原来的值也会被删除，以EvictRejected触发onEvict，不计入Evictions
+// 超过容量时先删除已经过期的元素，仍然超过容量时再淘汰最久未使用的元素；覆盖已有元素的值不会触发onEvict
+func (lru *LRUCache[K, V]) PutWithCost(key K, value V, cost int64, ttl time.Duration) bool {
 	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	defer lru.unlock()
+
+	if cost < 0 || (lru.costLimited && cost > lru.maxCost) {
+		lru.stats.Rejected++
+		if elem, ok := lru.cache[key]; ok {
+			lru.removeElementLocked(elem, EvictRejected)
+		}
+		return false
+	}
+
+	now := lru.now()
+	var expireAt time.Time
+	if ttl > 0 {
+		expireAt = now.Add(ttl)
+	}
 	if elem, ok := lru.cache[key]; ok {
-		elem.Value.(*Entry).value = value
+		entry := elem.Value.(*Entry[K, V])
+		entry.value = value
+		lru.cost += cost - entry.cost
+		entry.cost = cost
+		lru.setExpireLocked(entry, expireAt)
 		lru.lrulist.MoveToFront(elem)
-		return
+	} else {
+		// miss
+		entry := &Entry[K, V]{key: key, value: value, cost: cost, index: -1}
+		lru.setExpireLocked(entry, expireAt)
+		lru.cache[key] = lru.lrulist.PushFront(entry)
+		lru.cost += cost
 	}
-	// miss
-	elem := lru.lrulist.PushFront(&Entry{key: key, value: value})
-	lru.cache[key] = elem
-	if lru.lrulist.Len() > lru.capacity {
-		back := lru.lrulist.Back()
-		lru.lrulist.Remove(back)
-		delete(lru.cache, back.Value.(*Entry).key)
+	if lru.overLocked() {
+		lru.removeExpiredLocked(now)
+	}
+	for lru.overLocked() {
+		lru.removeElementLocked(lru.lrulist.Back(), EvictCapacity)
+	}
+	return true
+}
+
+// overLocked 判断元素数量或者总成本是否超过了限制
+func (lru *LRUCache[K, V]) overLocked() bool {
+	return lru.lrulist.Len() > lru.capacity || (lru.costLimited && lru.cost > lru.maxCost)
+}
+
+// Delete 删除元素，返回元素是否存在
+func (lru *LRUCache[K, V]) Delete(key K) bool {
+	lru.mu.Lock()
+	defer lru.unlock()
+
+	elem, ok := lru.cache[key]
+	if !ok {
+		return false
+	}
+	if elem.Value.(*Entry[K, V]).expired(lru.now()) {
+		lru.removeElementLocked(elem, EvictExpired)
+		return false
+	}
+	lru.removeElementLocked(elem, EvictDeleted)
+	return true
+}
+
+// Len 返回缓存中未过期的元素数量
+func (lru *LRUCache[K, V]) Len() int {
+	lru.mu.Lock()
+	defer lru.unlock()
+	lru.removeExpiredLocked(lru.now())
+	return lru.lrulist.Len()
+}
+
+// Keys 按从最近使用到最久未使用的顺序返回所有未过期的key
+func (lru *LRUCache[K, V]) Keys() []K {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	now := lru.now()
+	keys := make([]K, 0, lru.lrulist.Len())
+	for elem := lru.lrulist.Front(); elem != nil; elem = elem.Next() {
+		if entry := elem.Value.(*Entry[K, V]); !entry.expired(now) {
+			keys = append(keys, entry.key)
+		}
+	}
+	return keys
+}
+
+// Purge 删除所有元素，每个元素都会以EvictDeleted触发onEvict
+func (lru *LRUCache[K, V]) Purge() {
+	lru.mu.Lock()
+	defer lru.unlock()
+	if lru.onEvict != nil {
+		for elem := lru.lrulist.Back(); elem != nil; elem = elem.Prev() {
+			entry := elem.Value.(*Entry[K, V])
+			lru.evicted = append(lru.evicted, eviction[K, V]{entry.key, entry.value, EvictDeleted})
+		}
+	}
+	lru.cache = make(map[K]*list.Element)
+	lru.lrulist.Init()
+	lru.cost = 0
+	lru.expiry = nil
+}
+
+// Stop 停止后台清理goroutine，重复调用是安全的
+func (lru *LRUCache[K, V]) Stop() {
+	lru.stopOnce.Do(func() {
+		close(lru.stop)
+	})
+}
+
+func (lru *LRUCache[K, V]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lru.mu.Lock()
+			lru.removeExpiredLocked(lru.now())
+			lru.unlock()
+		case <-lru.stop:
+			return
+		}
+	}
+}
+
+func (lru *LRUCache[K, V]) setExpireLocked(entry *Entry[K, V], expireAt time.Time) {
+	entry.expireAt = expireAt
+	switch {
+	case expireAt.IsZero() && entry.index >= 0:
+		heap.Remove(&lru.expiry, entry.index)
+	case expireAt.IsZero():
+	case entry.index >= 0:
+		heap.Fix(&lru.expiry, entry.index)
+	default:
+		heap.Push(&lru.expiry, entry)
+	}
+}
+
+// removeExpiredLocked 从堆顶开始删除所有已经过期的元素
+func (lru *LRUCache[K, V]) removeExpiredLocked(now time.Time) {
+	for len(lru.expiry) > 0 && lru.expiry[0].expired(now) {
+		lru.removeElementLocked(lru.cache[lru.expiry[0].key], EvictExpired)
+	}
+}
+
+func (lru *LRUCache[K, V]) removeElementLocked(elem *list.Element, reason EvictReason) {
+	entry := lru.lrulist.Remove(elem).(*Entry[K, V])
+	delete(lru.cache, entry.key)
+	lru.cost -= entry.cost
+	if entry.index >= 0 {
+		heap.Remove(&lru.expiry, entry.index)
+	}
+	switch reason {
+	case EvictCapacity:
+		lru.stats.Evictions++
+	case EvictExpired:
+		lru.stats.Expirations++
+	}
+	if lru.onEvict != nil {
+		lru.evicted = append(lru.evicted, eviction[K, V]{entry.key, entry.value, reason})
+	}
+}
+
+// SetOnEvict 设置元素被移除时的回调，传入nil表示取消
+// 回调在释放锁之后按移除的顺序执行，不同goroutine触发的回调可能并发执行
+func (lru *LRUCache[K, V]) SetOnEvict(fn func(key K, value V, reason EvictReason)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.onEvict = fn
+}
+
+// Stats 返回统计信息的快照
+func (lru *LRUCache[K, V]) Stats() CacheStats {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	stats := lru.stats
+	stats.Cost = lru.cost
+	return stats
+}
+
+// unlock 释放写锁，然后对持有锁期间移除的元素调用onEvict
+func (lru *LRUCache[K, V]) unlock() {
+	evicted, onEvict := lru.evicted, lru.onEvict
+	lru.evicted = nil
+	lru.mu.Unlock()
+	for _, e := range evicted {
+		onEvict(e.key, e.value, e.reason)
+	}
+}
+
+func TestConcurrency11LRU(t *testing.T) {
+	t.Run("淘汰最久未使用的元素", func(t *testing.T) {
+		lru := NewLRUCache[int, int](2)
+		lru.Put(1, 10)
+		lru.Put(2, 20)
+		lru.Get(1) // 1 变为最近使用
+		lru.Put(3, 30)
+
+		if _, ok := lru.Get(2); ok {
+			t.Error("期望 key 2 被淘汰")
+		}
+		for key, want := range map[int]int{1: 10, 3: 30} {
+			if val, ok := lru.Get(key); !ok || val != want {
+				t.Errorf("key %d: 期望 %d，实际 %d, %v", key, want, val, ok)
+			}
+		}
+		lru.Put(1, 11)
+		if val, _ := lru.Get(1); val != 11 {
+			t.Errorf("期望更新后的值 11，实际 %d", val)
+		}
+		if n := lru.Len(); n != 2 {
+			t.Errorf("期望 2 个元素，实际 %d 个", n)
+		}
+	})
+
+	// 使用 go test -race 运行，Get 持有读锁修改链表时会报告数据竞争
+	t.Run("并发 Get 和 Put", func(t *testing.T) {
+		lru := NewLRUCache[int, int](64)
+		for i := 0; i < 64; i++ {
+			lru.Put(i, i)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					key := (id*31 + i) % 128
+					if i%4 == 0 {
+						lru.Put(key, key)
+					} else if val, ok := lru.Get(key); ok && val != key {
+						t.Errorf("key %d: 期望 %d，实际 %d", key, key, val)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		if n := lru.Len(); n != 64 {
+			t.Errorf("期望 64 个元素，实际 %d 个", n)
+		}
+		if n := len(lru.cache); n != lru.lrulist.Len() {
+			t.Errorf("map 和链表的元素数量不一致：%d != %d", n, lru.lrulist.Len())
+		}
+	})
+}
+
+func TestConcurrency11TTL(t *testing.T) {
+	t.Run("任意类型的 key 和 value", func(t *testing.T) {
+		type user struct {
+			name string
+			age  int
+		}
+		lru := NewLRUCache[string, user](2)
+		lru.Put("u1", user{"alice", 20})
+		lru.Put("u2", user{"bob", 30})
+		lru.Put("u3", user{"carol", 40})
+
+		if _, ok := lru.Get("u1"); ok {
+			t.Error("期望 u1 被淘汰")
+		}
+		if u, ok := lru.Get("u3"); !ok || u.name != "carol" {
+			t.Errorf("期望获取到 carol，实际 %+v, %v", u, ok)
+		}
+	})
+
+	t.Run("访问时删除过期的元素", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithTTL[string, int](10, time.Minute, 0)
+		lru.now = clock.Now
+
+		lru.Put("default", 1)
+		lru.PutWithTTL("short", 2, time.Second)
+		lru.PutWithTTL("forever", 3, 0)
+
+		clock.Advance(2 * time.Second)
+		if _, ok := lru.Get("short"); ok {
+			t.Error("期望 short 已经过期")
+		}
+		if _, ok := lru.Peek("default"); !ok {
+			t.Error("期望 default 还没有过期")
+		}
+
+		clock.Advance(time.Minute)
+		if _, ok := lru.Get("default"); ok {
+			t.Error("期望 default 已经过期")
+		}
+		if val, ok := lru.Get("forever"); !ok || val != 3 {
+			t.Errorf("期望 forever 不过期，实际 %d, %v", val, ok)
+		}
+		if n := lru.Len(); n != 1 {
+			t.Errorf("期望剩下 1 个元素，实际 %d 个", n)
+		}
+
+		// 重新写入时更新过期时间
+		lru.PutWithTTL("forever", 4, time.Second)
+		clock.Advance(time.Second)
+		if _, ok := lru.Get("forever"); ok {
+			t.Error("期望重新设置过期时间后 forever 过期")
+		}
+	})
+
+	t.Run("过期的元素不占用容量", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithTTL[string, int](2, 0, 0)
+		lru.now = clock.Now
+
+		lru.PutWithTTL("x", 1, time.Second)
+		lru.Put("y", 2)
+		lru.Get("x") // x 变为最近使用，y 是最久未使用的元素
+		clock.Advance(2 * time.Second)
+		lru.Put("z", 3)
+
+		if _, ok := lru.Get("y"); !ok {
+			t.Error("期望先删除过期的 x，而不是淘汰未过期的 y")
+		}
+		if keys := lru.Keys(); fmt.Sprint(keys) != "[y z]" {
+			t.Errorf("期望 keys 为 [y z]，实际 %v", keys)
+		}
+	})
+
+	t.Run("Peek 不改变使用顺序", func(t *testing.T) {
+		lru := NewLRUCache[int, int](2)
+		lru.Put(1, 10)
+		lru.Put(2, 20)
+		if val, ok := lru.Peek(1); !ok || val != 10 {
+			t.Errorf("期望 Peek 到 10，实际 %d, %v", val, ok)
+		}
+		lru.Put(3, 30)
+		if _, ok := lru.Peek(1); ok {
+			t.Error("期望 Peek 之后 key 1 仍然是最久未使用的元素并被淘汰")
+		}
+	})
+
+	t.Run("Delete、Keys 和 Purge", func(t *testing.T) {
+		lru := NewLRUCache[int, string](5)
+		for i := 1; i <= 4; i++ {
+			lru.Put(i, fmt.Sprint(i))
+		}
+		lru.Get(1)
+		if !lru.Delete(3) {
+			t.Error("期望删除存在的 key 返回 true")
+		}
+		if lru.Delete(3) {
+			t.Error("期望删除不存在的 key 返回 false")
+		}
+		if keys := lru.Keys(); fmt.Sprint(keys) != "[1 4 2]" {
+			t.Errorf("期望 keys 为 [1 4 2]，实际 %v", keys)
+		}
+		lru.Purge()
+		if n := lru.Len(); n != 0 {
+			t.Errorf("期望 Purge 之后为空，实际 %d 个元素", n)
+		}
+		lru.Put(5, "5")
+		if val, ok := lru.Get(5); !ok || val != "5" {
+			t.Error("期望 Purge 之后可以继续使用")
+		}
+	})
+
+	t.Run("后台清理过期的元素", func(t *testing.T) {
+		lru := NewLRUCacheWithTTL[int, int](100, 10*time.Millisecond, 5*time.Millisecond)
+		defer lru.Stop()
+		for i := 0; i < 50; i++ {
+			lru.Put(i, i)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		// 不调用任何会触发删除的方法，直接检查内部状态
+		lru.mu.RLock()
+		n := lru.lrulist.Len()
+		lru.mu.RUnlock()
+		if n != 0 {
+			t.Errorf("期望后台 goroutine 清理所有过期元素，实际剩下 %d 个", n)
+		}
+		lru.Stop()
+	})
+
+	t.Run("并发读写带过期时间的元素", func(t *testing.T) {
+		lru := NewLRUCacheWithTTL[int, int](64, time.Millisecond, time.Millisecond)
+		defer lru.Stop()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					key := (id*31 + i) % 128
+					switch i % 5 {
+					case 0:
+						lru.PutWithTTL(key, key, time.Duration(i%3)*time.Millisecond)
+					case 1:
+						lru.Delete(key)
+					case 2:
+						lru.Keys()
+					default:
+						if val, ok := lru.Get(key); ok && val != key {
+							t.Errorf("key %d: 期望 %d，实际 %d", key, key, val)
+						}
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		lru.mu.RLock()
+		defer lru.mu.RUnlock()
+		if len(lru.cache) != lru.lrulist.Len() || len(lru.expiry) > lru.lrulist.Len() {
+			t.Errorf("内部状态不一致：map %d，链表 %d，堆 %d", len(lru.cache), lru.lrulist.Len(), len(lru.expiry))
+		}
+	})
+}
+
+func TestConcurrency11Evict(t *testing.T) {
+	type evicted struct {
+		key    string
+		value  int
+		reason EvictReason
 	}
+
+	t.Run("按原因触发 OnEvict", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithTTL[string, int](2, 0, 0)
+		lru.now = clock.Now
+		var got []evicted
+		lru.SetOnEvict(func(key string, value int, reason EvictReason) {
+			got = append(got, evicted{key, value, reason})
+		})
+
+		lru.Put("a", 1)
+		lru.Put("b", 2)
+		lru.Put("a", 10) // 覆盖不触发回调
+		lru.Put("c", 3)  // 淘汰 b
+		lru.PutWithTTL("d", 4, time.Second)
+		clock.Advance(time.Second)
+		lru.Get("d") // d 过期
+		lru.Delete("a")
+		lru.Put("e", 5)
+		lru.Purge()
+
+		want := []evicted{
+			{"b", 2, EvictCapacity},
+			{"a", 10, EvictCapacity},
+			{"d", 4, EvictExpired},
+			{"c", 3, EvictDeleted},
+			{"e", 5, EvictDeleted},
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("期望回调 %v，实际 %v", want, got)
+		}
+	})
+
+	t.Run("回调在锁外执行", func(t *testing.T) {
+		lru := NewLRUCache[int, int](1)
+		var flushed []int
+		lru.SetOnEvict(func(key int, value int, reason EvictReason) {
+			// 在回调中访问缓存，持有锁时执行会死锁
+			lru.Len()
+			if _, ok := lru.Peek(key); ok {
+				t.Errorf("回调执行时 key %d 仍然在缓存中", key)
+			}
+			flushed = append(flushed, value)
+		})
+
+		done := make(chan struct{})
+		go func() {
+			lru.Put(1, 10)
+			lru.Put(2, 20)
+			lru.Put(3, 30)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("在回调中访问缓存导致死锁")
+		}
+		if fmt.Sprint(flushed) != "[10 20]" {
+			t.Errorf("期望写回 [10 20]，实际 %v", flushed)
+		}
+	})
+
+	t.Run("命中率统计", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithTTL[int, int](2, time.Minute, 0)
+		lru.now = clock.Now
+
+		if ratio := lru.Stats().HitRatio(); ratio != 0 {
+			t.Errorf("期望没有访问时命中率为 0，实际 %v", ratio)
+		}
+		lru.Put(1, 1)
+		lru.Put(2, 2)
+		lru.Put(3, 3) // 淘汰 1
+		lru.Get(1)    // miss
+		lru.Get(2)    // hit
+		lru.Get(3)    // hit
+		lru.Peek(2)   // 不计入
+		clock.Advance(time.Minute)
+		lru.Get(2) // 过期，miss
+
+		want := CacheStats{Hits: 2, Misses: 2, Evictions: 1, Expirations: 1, Cost: 1}
+		if stats := lru.Stats(); stats != want {
+			t.Errorf("期望 %+v，实际 %+v", want, stats)
+		}
+		if ratio := lru.Stats().HitRatio(); ratio != 0.5 {
+			t.Errorf("期望命中率 0.5，实际 %v", ratio)
+		}
+	})
+
+	t.Run("并发访问时回调次数和淘汰次数一致", func(t *testing.T) {
+		lru := NewLRUCache[int, int](16)
+		var callbacks [3]int64
+		lru.SetOnEvict(func(key int, value int, reason EvictReason) {
+			atomic.AddInt64(&callbacks[reason], 1)
+		})
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					key := (id*17 + i) % 64
+					switch i % 4 {
+					case 0, 1:
+						lru.Put(key, key)
+					case 2:
+						lru.Get(key)
+					default:
+						lru.Delete(key)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		stats := lru.Stats()
+		if uint64(callbacks[EvictCapacity]) != stats.Evictions {
+			t.Errorf("淘汰回调 %d 次，统计 %d 次", callbacks[EvictCapacity], stats.Evictions)
+		}
+		if stats.Hits+stats.Misses != 8*250 {
+			t.Errorf("期望 %d 次 Get，实际统计 %d 次", 8*250, stats.Hits+stats.Misses)
+		}
+		t.Logf("%+v，命中率 %.2f，删除回调 %d 次", stats, stats.HitRatio(), callbacks[EvictDeleted])
+	})
+}
+
+func TestConcurrency11Cost(t *testing.T) {
+	sizer := func(key string, value []byte) int64 { return int64(len(value)) }
+
+	t.Run("总成本超过上限时淘汰", func(t *testing.T) {
+		lru := NewLRUCacheWithCost[string, []byte](100, sizer)
+		var evicted []string
+		lru.SetOnEvict(func(key string, value []byte, reason EvictReason) {
+			evicted = append(evicted, key)
+		})
+
+		lru.Put("a", make([]byte, 40))
+		lru.Put("b", make([]byte, 40))
+		lru.Get("a")
+		lru.Put("c", make([]byte, 40)) // 淘汰最久未使用的 b
+
+		if fmt.Sprint(evicted) != "[b]" {
+			t.Errorf("期望淘汰 [b]，实际 %v", evicted)
+		}
+		if stats := lru.Stats(); stats.Cost != 80 || stats.Evictions != 1 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+
+		// 一个大元素可以淘汰多个小元素
+		lru.Put("big", make([]byte, 90))
+		if keys := lru.Keys(); fmt.Sprint(keys) != "[big]" {
+			t.Errorf("期望只剩下 [big]，实际 %v", keys)
+		}
+		if cost := lru.Stats().Cost; cost != 90 {
+			t.Errorf("期望总成本 90，实际 %d", cost)
+		}
+	})
+
+	t.Run("拒绝超过上限的元素", func(t *testing.T) {
+		lru := NewLRUCacheWithCost[string, []byte](100, sizer)
+		lru.Put("a", make([]byte, 10))
+		lru.Put("b", make([]byte, 10))
+
+		if lru.PutWithCost("huge", nil, 101, 0) {
+			t.Error("期望拒绝成本超过上限的元素")
+		}
+		// 拒绝时不淘汰其他元素，并删除同一个 key 原来的值
+		lru.Put("a", make([]byte, 200))
+		if _, ok := lru.Get("a"); ok {
+			t.Error("期望 a 原来的值被删除")
+		}
+		if _, ok := lru.Get("b"); !ok {
+			t.Error("期望拒绝写入时不淘汰其他元素")
+		}
+		if stats := lru.Stats(); stats.Rejected != 2 || stats.Cost != 10 || stats.Evictions != 0 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+
+	t.Run("拒绝负数成本", func(t *testing.T) {
+		lru := NewLRUCacheWithCost[string, []byte](100, func(key string, value []byte) int64 {
+			if key == "bad" {
+				return -50
+			}
+			return int64(len(value))
+		})
+		var reasons []EvictReason
+		lru.SetOnEvict(func(key string, value []byte, reason EvictReason) {
+			reasons = append(reasons, reason)
+		})
+
+		lru.Put("a", make([]byte, 60))
+		lru.Put("bad", make([]byte, 60))
+		if lru.PutWithCost("a", nil, -1, 0) {
+			t.Error("期望拒绝负数成本")
+		}
+		if _, ok := lru.Peek("bad"); ok {
+			t.Error("期望 Sizer 返回负数时拒绝写入")
+		}
+		if _, ok := lru.Peek("a"); ok {
+			t.Error("期望拒绝写入时删除 a 原来的值")
+		}
+		lru.Put("b", make([]byte, 60))
+		lru.Put("c", make([]byte, 60))
+		if stats := lru.Stats(); stats.Cost != 60 || stats.Rejected != 2 || stats.Evictions != 1 {
+			t.Errorf("期望总成本不超过上限，实际 %+v", stats)
+		}
+		if fmt.Sprint(reasons) != "[rejected capacity]" {
+			t.Errorf("期望移除原因为 [rejected capacity]，实际 %v", reasons)
+		}
+	})
+
+	t.Run("更新元素时重新计算成本", func(t *testing.T) {
+		lru := NewLRUCacheWithCost[string, []byte](100, sizer)
+		lru.Put("a", make([]byte, 10))
+		lru.Put("b", make([]byte, 20))
+		lru.Put("a", make([]byte, 90)) // a 变为最近使用，总成本 110，淘汰 b
+
+		if _, ok := lru.Peek("b"); ok {
+			t.Error("期望 b 被淘汰")
+		}
+		if cost := lru.Stats().Cost; cost != 90 {
+			t.Errorf("期望总成本 90，实际 %d", cost)
+		}
+		lru.Put("a", make([]byte, 5))
+		if cost := lru.Stats().Cost; cost != 5 {
+			t.Errorf("期望总成本 5，实际 %d", cost)
+		}
+	})
+
+	t.Run("先删除过期的元素", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithCost[string, []byte](100, sizer)
+		lru.now = clock.Now
+
+		lru.PutWithCost("short", nil, 50, time.Second)
+		lru.Put("long", make([]byte, 40))
+		lru.Get("short")
+		clock.Advance(time.Second)
+		lru.Put("new", make([]byte, 50))
+
+		if _, ok := lru.Get("long"); !ok {
+			t.Error("期望先删除过期的元素，而不是淘汰未过期的 long")
+		}
+		if stats := lru.Stats(); stats.Expirations != 1 || stats.Evictions != 0 || stats.Cost != 90 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+
+	t.Run("maxCost 不合法时拒绝写入", func(t *testing.T) {
+		for _, maxCost := range []int64{0, -1} {
+			lru := NewLRUCacheWithCost[string, []byte](maxCost, sizer)
+			for i := 0; i < 10; i++ {
+				lru.Put(fmt.Sprint(i), make([]byte, 10))
+			}
+			if n, stats := lru.Len(), lru.Stats(); n != 0 || stats.Rejected != 10 || stats.Cost != 0 {
+				t.Errorf("maxCost=%d: 期望拒绝所有写入，实际 %d 个元素，%+v", maxCost, n, stats)
+			}
+		}
+	})
+
+	t.Run("按数量限制时每个元素的成本为 1", func(t *testing.T) {
+		lru := NewLRUCache[int, int](3)
+		for i := 0; i < 5; i++ {
+			lru.Put(i, i)
+		}
+		if cost := lru.Stats().Cost; cost != 3 {
+			t.Errorf("期望总成本 3，实际 %d", cost)
+		}
+		lru.Purge()
+		if cost := lru.Stats().Cost; cost != 0 {
+			t.Errorf("期望 Purge 之后总成本为 0，实际 %d", cost)
+		}
+	})
 }
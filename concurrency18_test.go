@@ -1,25 +1,50 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // 实现一个固定数量的工作线程池，任务提交不阻塞，任务满时返回错误，支持优雅关闭
 // pool := NewPool(5, 100)
 // pool.Submit(task)
 // pool.Shutdown()
+//
+// 另外支持几种不同的背压方式：SubmitWait阻塞直到入队，SubmitTimeout超时放弃，SubmitBatch要么全部入队要么全部拒绝
+
+var (
+	ErrPoolClosed  = errors.New("task queue is closed.")
+	ErrPoolFull    = errors.New("task queue is full.")
+	ErrPoolTimeout = errors.New("task submit timeout.")
+)
+
 type Pool struct {
-	tasks  chan func()
-	closed uint32
-	wg     sync.WaitGroup
+	tasks        chan func()
+	closed       uint32
+	done         chan struct{} // Shutdown时关闭，唤醒阻塞在提交上的goroutine
+	shutdownOnce sync.Once
+	mu           sync.RWMutex // 向队列发送时持有读锁，关闭队列时持有写锁，避免向已关闭的channel发送数据
+	wg           sync.WaitGroup
+	metrics      *poolMetrics
+
+	// 有缓冲的队列先在slotMu保护下预留位置再发送，预留成功之后发送一定不会阻塞，
+	// 所以持有读锁的时间很短，SubmitBatch也可以一次预留多个位置实现原子提交
+	slotMu     sync.Mutex
+	reserved   int           // 已经预留但还没有被worker取出的任务数
+	slotFreed  chan struct{} // worker取出任务时关闭并替换，唤醒等待空位的提交者
+	slotWanted bool          // 有提交者在等待slotFreed
 }
 
 func NewPool(workers, queueSize int) *Pool {
 	pool := &Pool{
-		tasks: make(chan func(), queueSize),
+		tasks:     make(chan func(), queueSize),
+		done:      make(chan struct{}),
+		metrics:   newPoolMetrics(),
+		slotFreed: make(chan struct{}),
 	}
 	pool.wg.Add(workers)
 	for i := 0; i < workers; i++ {
@@ -27,6 +52,7 @@ func NewPool(workers, queueSize int) *Pool {
 			defer pool.wg.Done()
 
 			for task := range pool.tasks {
+				pool.releaseSlot()
 				task()
 			}
 		}()
@@ -35,19 +61,168 @@ func NewPool(workers, queueSize int) *Pool {
 }
 
 func (pool *Pool) Submit(task func()) error {
+	return pool.submit(task, false, nil)
+}
+
+// SubmitWait 阻塞直到任务入队或者pool被关闭
+func (pool *Pool) SubmitWait(task func()) error {
+	return pool.submit(task, true, nil)
+}
+
+// SubmitTimeout 最多阻塞timeout，超时返回ErrPoolTimeout
+func (pool *Pool) SubmitTimeout(task func(), timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return pool.submit(task, true, timer.C)
+}
+
+func (pool *Pool) submit(task func(), block bool, timeout <-chan time.Time) error {
+	pool.metrics.submitted()
+	var err error
+	if cap(pool.tasks) == 0 {
+		err = pool.handoff(pool.wrap(task), block, timeout)
+	} else {
+		err = pool.enqueue([]func(){pool.wrap(task)}, block, timeout)
+	}
+	if err != nil {
+		pool.metrics.rejected(err)
+	}
+	return err
+}
+
+// SubmitBatch 原子地提交一批任务，队列剩余空间不足时全部拒绝并返回ErrPoolFull
+// 一次预留所有任务需要的位置，其他提交者不会占用预留的位置，所以不需要持有写锁
+func (pool *Pool) SubmitBatch(tasks []func()) error {
+	wrapped := make([]func(), len(tasks))
+	for i, task := range tasks {
+		pool.metrics.submitted()
+		wrapped[i] = pool.wrap(task)
+	}
+	if err := pool.enqueue(wrapped, false, nil); err != nil {
+		for range tasks {
+			pool.metrics.rejected(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// enqueue 预留len(tasks)个位置，然后把任务发送到有缓冲的队列
+func (pool *Pool) enqueue(tasks []func(), block bool, timeout <-chan time.Time) error {
+	if atomic.LoadUint32(&pool.closed) == 1 {
+		return ErrPoolClosed
+	}
+	if err := pool.reserve(len(tasks), block, timeout); err != nil {
+		return err
+	}
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if atomic.LoadUint32(&pool.closed) == 1 {
+		return ErrPoolClosed
+	}
+	for _, task := range tasks {
+		pool.tasks <- task // 已经预留了位置，不会阻塞
+	}
+	return nil
+}
+
+// reserve 预留n个位置，不阻塞时空间不足直接返回ErrPoolFull
+// 等待空位时不持有任何锁，Shutdown和超时都可以及时唤醒
+func (pool *Pool) reserve(n int, block bool, timeout <-chan time.Time) error {
+	for {
+		pool.slotMu.Lock()
+		if pool.reserved+n <= cap(pool.tasks) {
+			pool.reserved += n
+			pool.slotMu.Unlock()
+			return nil
+		}
+		if !block {
+			pool.slotMu.Unlock()
+			return ErrPoolFull
+		}
+		pool.slotWanted = true
+		freed := pool.slotFreed
+		pool.slotMu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return ErrPoolTimeout
+		case <-pool.done:
+			return ErrPoolClosed
+		}
+	}
+}
+
+// releaseSlot worker取出一个任务之后归还它的位置，有提交者在等待时唤醒它们
+func (pool *Pool) releaseSlot() {
+	if cap(pool.tasks) == 0 {
+		return
+	}
+	pool.slotMu.Lock()
+	pool.reserved--
+	if pool.slotWanted {
+		close(pool.slotFreed)
+		pool.slotFreed = make(chan struct{})
+		pool.slotWanted = false
+	}
+	pool.slotMu.Unlock()
+}
+
+// handoff 把任务直接交给空闲的worker，用于没有缓冲的队列
+// 阻塞时持有读锁，但是只有Shutdown会获取写锁，它先关闭done唤醒所有阻塞的提交者
+func (pool *Pool) handoff(task func(), block bool, timeout <-chan time.Time) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
 	if atomic.LoadUint32(&pool.closed) == 1 {
-		return fmt.Errorf("task queue is closed.")
+		return ErrPoolClosed
+	}
+	if !block {
+		select {
+		case pool.tasks <- task:
+			return nil
+		default:
+			return ErrPoolFull
+		}
 	}
 	select {
 	case pool.tasks <- task:
 		return nil
-	default:
-		return fmt.Errorf("task queue is full.")
+	case <-timeout:
+		return ErrPoolTimeout
+	case <-pool.done:
+		return ErrPoolClosed
+	}
+}
+
+// wrap 记录任务的排队时间和执行时间
+func (pool *Pool) wrap(task func()) func() {
+	enqueued := time.Now()
+	return func() {
+		started := pool.metrics.start(enqueued)
+		defer pool.metrics.finish(started, nil)
+		task()
 	}
 }
+
+// Stats 返回当前的指标快照，Pool的任务没有返回值，所以Failed始终为0
+func (pool *Pool) Stats() PoolStats {
+	return pool.metrics.snapshot()
+}
+
+// SetHook 设置指标回调，传入nil表示取消
+func (pool *Pool) SetHook(hook PoolHook) {
+	pool.metrics.setHook(hook)
+}
+
 func (pool *Pool) Shutdown() {
-	atomic.StoreUint32(&pool.closed, 1)
-	close(pool.tasks)
+	pool.shutdownOnce.Do(func() {
+		atomic.StoreUint32(&pool.closed, 1)
+		close(pool.done)
+		pool.mu.Lock()
+		close(pool.tasks)
+		pool.mu.Unlock()
+	})
 	pool.wg.Wait()
 }
 func TestConcurrency18(t *testing.T) {
@@ -62,3 +237,183 @@ func TestConcurrency18(t *testing.T) {
 	}
 	pool.Shutdown()
 }
+
+func TestConcurrency18SubmitModes(t *testing.T) {
+	t.Run("SubmitWait 阻塞直到有空位", func(t *testing.T) {
+		pool := NewPool(1, 1)
+
+		blockChan := make(chan struct{})
+		pool.SubmitWait(func() { <-blockChan })
+		pool.SubmitWait(func() {})
+
+		submitted := make(chan error)
+		go func() {
+			submitted <- pool.SubmitWait(func() {})
+		}()
+		select {
+		case err := <-submitted:
+			t.Fatalf("期望队列满时 SubmitWait 阻塞，实际返回 %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(blockChan)
+		if err := <-submitted; err != nil {
+			t.Errorf("期望 SubmitWait 成功，实际返回 %v", err)
+		}
+		pool.Shutdown()
+		if stats := pool.Stats(); stats.Completed != 3 {
+			t.Errorf("期望执行 3 个任务，实际执行了 %d 个", stats.Completed)
+		}
+	})
+
+	t.Run("SubmitTimeout 超时返回错误", func(t *testing.T) {
+		pool := NewPool(1, 0)
+
+		blockChan := make(chan struct{})
+		pool.SubmitWait(func() { <-blockChan })
+
+		start := time.Now()
+		if err := pool.SubmitTimeout(func() {}, 20*time.Millisecond); !errors.Is(err, ErrPoolTimeout) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("SubmitTimeout 过早返回，耗时 %v", elapsed)
+		}
+
+		close(blockChan)
+		if err := pool.SubmitTimeout(func() {}, time.Second); err != nil {
+			t.Errorf("期望 SubmitTimeout 成功，实际返回 %v", err)
+		}
+		pool.Shutdown()
+		if stats := pool.Stats(); stats.RejectedTimeout != 1 {
+			t.Errorf("期望统计到 1 次超时，实际 %d 次", stats.RejectedTimeout)
+		}
+	})
+
+	t.Run("SubmitBatch 全部入队或全部拒绝", func(t *testing.T) {
+		pool := NewPool(1, 3)
+
+		blockChan := make(chan struct{})
+		started := make(chan struct{})
+		pool.Submit(func() {
+			close(started)
+			<-blockChan
+		})
+		<-started
+
+		var counter int32
+		task := func() { atomic.AddInt32(&counter, 1) }
+		if err := pool.SubmitBatch([]func(){task, task}); err != nil {
+			t.Fatalf("期望批量提交成功，实际返回 %v", err)
+		}
+		// 队列只剩 1 个空位，2 个任务的批次应该整体被拒绝
+		if err := pool.SubmitBatch([]func(){task, task}); !errors.Is(err, ErrPoolFull) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolFull, err)
+		}
+		if stats := pool.Stats(); stats.Queued != 2 {
+			t.Errorf("期望队列中有 2 个任务，实际 %d 个", stats.Queued)
+		}
+
+		close(blockChan)
+		pool.Shutdown()
+		if counter != 2 {
+			t.Errorf("期望执行 2 个任务，实际执行了 %d 个", counter)
+		}
+		if err := pool.SubmitBatch([]func(){task}); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolClosed, err)
+		}
+	})
+
+	t.Run("等待空位的提交者不阻塞其他提交", func(t *testing.T) {
+		pool := NewPool(1, 1)
+
+		blockChan := make(chan struct{})
+		started := make(chan struct{})
+		pool.Submit(func() {
+			close(started)
+			<-blockChan
+		})
+		<-started
+		pool.Submit(func() {}) // 队列满
+
+		waited := make(chan error)
+		go func() {
+			waited <- pool.SubmitWait(func() {})
+		}()
+		batched := make(chan error)
+		go func() {
+			time.Sleep(10 * time.Millisecond) // 让 SubmitWait 先开始等待
+			batched <- pool.SubmitBatch([]func(){func() {}})
+		}()
+		if err := <-batched; !errors.Is(err, ErrPoolFull) {
+			t.Errorf("期望 SubmitBatch 返回 %v，实际返回 %v", ErrPoolFull, err)
+		}
+
+		start := time.Now()
+		if err := pool.SubmitTimeout(func() {}, 20*time.Millisecond); !errors.Is(err, ErrPoolTimeout) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("期望 SubmitTimeout 在 20ms 左右超时，实际耗时 %v", elapsed)
+		}
+		start = time.Now()
+		if err := pool.Submit(func() {}); !errors.Is(err, ErrPoolFull) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolFull, err)
+		}
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Errorf("期望 Submit 不阻塞，实际耗时 %v", elapsed)
+		}
+
+		close(blockChan)
+		select {
+		case err := <-waited:
+			if err != nil {
+				t.Errorf("期望 SubmitWait 在有空位之后成功，实际返回 %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("期望有空位之后唤醒 SubmitWait")
+		}
+		pool.Shutdown()
+		if stats := pool.Stats(); stats.Completed != 3 || stats.Queued != 0 {
+			t.Errorf("期望执行 3 个任务，实际 %+v", stats)
+		}
+	})
+
+	t.Run("并发提交和 Shutdown 不会 panic", func(t *testing.T) {
+		for round := 0; round < 20; round++ {
+			pool := NewPool(4, 8)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(id int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						var err error
+						switch id % 4 {
+						case 0:
+							err = pool.Submit(func() {})
+						case 1:
+							err = pool.SubmitWait(func() {})
+						case 2:
+							err = pool.SubmitTimeout(func() {}, time.Millisecond)
+						default:
+							err = pool.SubmitBatch([]func(){func() {}, func() {}})
+						}
+						if errors.Is(err, ErrPoolClosed) {
+							return
+						}
+					}
+				}(i)
+			}
+			time.Sleep(time.Millisecond)
+			pool.Shutdown()
+			wg.Wait()
+
+			stats := pool.Stats()
+			if stats.Queued != 0 || stats.Running != 0 {
+				t.Fatalf("第 %d 轮：期望关闭后 queued=0 running=0，实际 %+v", round, stats)
+			}
+		}
+	})
+}
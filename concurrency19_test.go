@@ -1,7 +1,11 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -14,22 +18,177 @@ import (
 //
 // 有界信号量在信号量的基础上限制了信号量的最大值，以防止资源过度使用。
 // Acquire(), Release()用于获取和释放信号量
+//
+// 带权重的版本AcquireN/TryAcquireN/ReleaseN一次获取或释放n个单位，AcquireN支持ctx取消，n必须大于0
+// 它们对应x/sync/semaphore的Acquire(ctx, n)/TryAcquire(n)/Release(n)，但名字加了N：
+// Go没有重载，原来的Acquire()/Release()已经被TestConcurrency19等调用方使用，不能改成带参数的签名。
+// 需要取消或者一次获取多个单位时使用AcquireN；Acquire()获取1个单位，不可取消，容量为0时一直等待而不是返回错误
+// 等待者按FIFO顺序获取，排在前面的大请求不会被后来的小请求饿死；释放的数量超过已获取的数量时返回错误
+//
+// SetLimit在运行时修改容量：变大时立即唤醒等待者，变小时已持有的单位不受影响，归还到新容量以下之后才允许新的获取
+
+var (
+	ErrSemaphoreOverRelease = errors.New("semaphore: released more than held")
+	ErrSemaphoreTooLarge    = errors.New("semaphore: acquire more than limit")
+	ErrSemaphoreInvalidN    = errors.New("semaphore: n must be positive")
+)
+
+type semaphoreWaiter struct {
+	n     int
+	wait  bool          // n超过容量时继续等待容量变大，而不是返回ErrSemaphoreTooLarge
+	ready chan struct{} // 获得信号量或者err被设置时关闭
+	err   error
+}
+
+// SemaphoreStats 是信号量的状态快照，Held是已经被持有的单位数，收缩容量之后可能暂时大于Limit
+type SemaphoreStats struct {
+	Limit   int
+	Held    int
+	Waiters int
+}
 
 type BoundedSemaphore struct {
-	ch chan struct{}
+	mu      sync.Mutex
+	size    int
+	cur     int
+	waiters *list.List // 元素是*semaphoreWaiter
 }
 
 func NewBoundedSemaphore(max int) *BoundedSemaphore {
 	return &BoundedSemaphore{
-		ch: make(chan struct{}, max),
+		size:    max,
+		waiters: list.New(),
 	}
 }
+
+// Acquire 获取1个单位，阻塞直到成功；容量为0时一直等待到SetLimit扩容
 func (bs *BoundedSemaphore) Acquire() {
-	bs.ch <- struct{}{}
+	bs.acquire(context.Background(), 1, true)
+}
+
+func (bs *BoundedSemaphore) Release() error {
+	return bs.ReleaseN(1)
+}
+
+// AcquireN 获取n个单位，阻塞直到成功或者ctx结束；n超过信号量容量时返回ErrSemaphoreTooLarge
+func (bs *BoundedSemaphore) AcquireN(ctx context.Context, n int) error {
+	return bs.acquire(ctx, n, false)
+}
+
+func (bs *BoundedSemaphore) acquire(ctx context.Context, n int, wait bool) error {
+	if n <= 0 {
+		return ErrSemaphoreInvalidN
+	}
+	bs.mu.Lock()
+	if n > bs.size && !wait {
+		bs.mu.Unlock()
+		return ErrSemaphoreTooLarge
+	}
+	if bs.waiters.Len() == 0 && bs.size-bs.cur >= n {
+		bs.cur += n
+		bs.mu.Unlock()
+		return nil
+	}
+	w := &semaphoreWaiter{n: n, wait: wait, ready: make(chan struct{})}
+	elem := bs.waiters.PushBack(w)
+	bs.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-ctx.Done():
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+		select {
+		case <-w.ready:
+			if w.err != nil {
+				return w.err
+			}
+			// 取消的同时获得了信号量，归还之后唤醒后面的等待者
+			bs.cur -= n
+			bs.notifyLocked()
+		default:
+			isFront := bs.waiters.Front() == elem
+			bs.waiters.Remove(elem)
+			// 排在队首的大请求取消后，后面的小请求可能已经可以获取
+			if isFront {
+				bs.notifyLocked()
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// TryAcquireN 不等待，可以立即获取n个单位时返回true，有其他等待者或者n<=0时返回false
+func (bs *BoundedSemaphore) TryAcquireN(n int) bool {
+	if n <= 0 {
+		return false
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.waiters.Len() == 0 && bs.size-bs.cur >= n {
+		bs.cur += n
+		return true
+	}
+	return false
 }
 
-func (bs *BoundedSemaphore) Release() {
-	<-bs.ch
+// ReleaseN 释放n个单位，释放的数量超过当前持有的数量时不做任何修改并返回ErrSemaphoreOverRelease
+func (bs *BoundedSemaphore) ReleaseN(n int) error {
+	if n <= 0 {
+		return ErrSemaphoreInvalidN
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if n > bs.cur {
+		return ErrSemaphoreOverRelease
+	}
+	bs.cur -= n
+	bs.notifyLocked()
+	return nil
+}
+
+// SetLimit 修改信号量的容量，n小于0时按0处理
+// 排队中请求数超过新容量的AcquireN等待者会被唤醒并返回ErrSemaphoreTooLarge，避免阻塞后面的等待者；
+// Acquire没有办法返回错误，它的等待者继续排队，直到容量重新变大
+func (bs *BoundedSemaphore) SetLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.size = n
+	for elem := bs.waiters.Front(); elem != nil; {
+		next := elem.Next()
+		if w := elem.Value.(*semaphoreWaiter); w.n > n && !w.wait {
+			w.err = ErrSemaphoreTooLarge
+			bs.waiters.Remove(elem)
+			close(w.ready)
+		}
+		elem = next
+	}
+	bs.notifyLocked()
+}
+
+// Stats 返回信号量当前的容量、已持有的单位数和等待者数量
+func (bs *BoundedSemaphore) Stats() SemaphoreStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return SemaphoreStats{Limit: bs.size, Held: bs.cur, Waiters: bs.waiters.Len()}
+}
+
+// notifyLocked 按FIFO顺序唤醒等待者，队首的请求无法满足时停止，保证大请求不会被饿死
+func (bs *BoundedSemaphore) notifyLocked() {
+	for bs.waiters.Len() > 0 {
+		front := bs.waiters.Front()
+		w := front.Value.(*semaphoreWaiter)
+		if bs.size-bs.cur < w.n {
+			return
+		}
+		bs.cur += w.n
+		bs.waiters.Remove(front)
+		close(w.ready)
+	}
 }
 
 func TestConcurrency19(t *testing.T) {
@@ -75,3 +234,381 @@ func TestConcurrency19(t *testing.T) {
 	t.Logf("测试通过，最大并发数: %d", maxRunning)
 
 }
+
+func TestConcurrency19Weighted(t *testing.T) {
+	t.Run("AcquireN 和 ReleaseN", func(t *testing.T) {
+		sem := NewBoundedSemaphore(10)
+		if err := sem.AcquireN(context.Background(), 7); err != nil {
+			t.Fatal(err)
+		}
+		if sem.TryAcquireN(4) {
+			t.Error("期望剩余 3 个单位时 TryAcquireN(4) 失败")
+		}
+		if !sem.TryAcquireN(3) {
+			t.Error("期望剩余 3 个单位时 TryAcquireN(3) 成功")
+		}
+		if err := sem.ReleaseN(10); err != nil {
+			t.Errorf("期望释放成功，实际返回 %v", err)
+		}
+		if err := sem.AcquireN(context.Background(), 11); !errors.Is(err, ErrSemaphoreTooLarge) {
+			t.Errorf("期望返回 %v，实际 %v", ErrSemaphoreTooLarge, err)
+		}
+	})
+
+	t.Run("n 必须大于 0", func(t *testing.T) {
+		sem := NewBoundedSemaphore(2)
+		for _, n := range []int{0, -3} {
+			if err := sem.AcquireN(context.Background(), n); !errors.Is(err, ErrSemaphoreInvalidN) {
+				t.Errorf("AcquireN(%d): 期望返回 %v，实际 %v", n, ErrSemaphoreInvalidN, err)
+			}
+			if sem.TryAcquireN(n) {
+				t.Errorf("TryAcquireN(%d): 期望返回 false", n)
+			}
+			if err := sem.ReleaseN(n); !errors.Is(err, ErrSemaphoreInvalidN) {
+				t.Errorf("ReleaseN(%d): 期望返回 %v，实际 %v", n, ErrSemaphoreInvalidN, err)
+			}
+		}
+		if stats := sem.Stats(); stats.Held != 0 {
+			t.Errorf("期望非法的 n 不修改状态，实际 %+v", stats)
+		}
+		if sem.TryAcquireN(3) {
+			t.Error("期望不能获取超过容量的单位")
+		}
+	})
+
+	t.Run("容量为 0 时 Acquire 阻塞", func(t *testing.T) {
+		sem := NewBoundedSemaphore(0)
+		done := make(chan struct{})
+		go func() {
+			sem.Acquire()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("期望容量为 0 时 Acquire 阻塞")
+		case <-time.After(20 * time.Millisecond):
+		}
+		if stats := sem.Stats(); stats.Held != 0 || stats.Waiters != 1 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+
+		// 扩容唤醒阻塞的 Acquire，避免 goroutine 泄漏到后面的测试
+		sem.SetLimit(1)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("期望扩容之后 Acquire 获取成功")
+		}
+	})
+
+	t.Run("释放超过持有的数量", func(t *testing.T) {
+		sem := NewBoundedSemaphore(3)
+		if err := sem.Release(); !errors.Is(err, ErrSemaphoreOverRelease) {
+			t.Errorf("期望返回 %v，实际 %v", ErrSemaphoreOverRelease, err)
+		}
+		sem.AcquireN(context.Background(), 2)
+		if err := sem.ReleaseN(3); !errors.Is(err, ErrSemaphoreOverRelease) {
+			t.Errorf("期望返回 %v，实际 %v", ErrSemaphoreOverRelease, err)
+		}
+		// 失败的释放不会修改状态
+		if sem.TryAcquireN(2) {
+			t.Error("期望失败的释放不归还任何单位")
+		}
+	})
+
+	t.Run("ctx 取消", func(t *testing.T) {
+		sem := NewBoundedSemaphore(1)
+		sem.Acquire()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := sem.AcquireN(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("AcquireN 过早返回，耗时 %v", elapsed)
+		}
+		sem.Release()
+		if !sem.TryAcquireN(1) {
+			t.Error("期望取消的等待者不占用信号量")
+		}
+	})
+
+	t.Run("大请求不会被小请求饿死", func(t *testing.T) {
+		sem := NewBoundedSemaphore(4)
+		sem.AcquireN(context.Background(), 2)
+
+		bigDone := make(chan struct{})
+		go func() {
+			sem.AcquireN(context.Background(), 4)
+			close(bigDone)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// 还剩 2 个单位，但大请求在排队，小请求不能插队
+		if sem.TryAcquireN(1) {
+			t.Error("期望有等待者时 TryAcquireN 失败")
+		}
+		smallDone := make(chan struct{})
+		go func() {
+			sem.AcquireN(context.Background(), 1)
+			close(smallDone)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-smallDone:
+			t.Fatal("小请求插队到大请求前面")
+		default:
+		}
+
+		sem.ReleaseN(2)
+		<-bigDone
+		select {
+		case <-smallDone:
+			t.Fatal("大请求持有全部单位时小请求不应该获取成功")
+		case <-time.After(10 * time.Millisecond):
+		}
+		sem.ReleaseN(4)
+		<-smallDone
+	})
+
+	t.Run("队首的大请求取消后唤醒后面的小请求", func(t *testing.T) {
+		sem := NewBoundedSemaphore(4)
+		sem.AcquireN(context.Background(), 3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		bigErr := make(chan error)
+		go func() {
+			bigErr <- sem.AcquireN(ctx, 4)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		smallDone := make(chan struct{})
+		go func() {
+			sem.AcquireN(context.Background(), 1)
+			close(smallDone)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		cancel()
+		if err := <-bigErr; !errors.Is(err, context.Canceled) {
+			t.Errorf("期望返回 %v，实际 %v", context.Canceled, err)
+		}
+		select {
+		case <-smallDone:
+		case <-time.After(time.Second):
+			t.Fatal("大请求取消后小请求仍然阻塞")
+		}
+	})
+
+	t.Run("并发获取和释放", func(t *testing.T) {
+		sem := NewBoundedSemaphore(10)
+
+		var wg sync.WaitGroup
+		var held, exceeded int32
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				n := id%4 + 1
+				for j := 0; j < 50; j++ {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+					err := sem.AcquireN(ctx, n)
+					cancel()
+					if err != nil {
+						continue
+					}
+					if atomic.AddInt32(&held, int32(n)) > 10 {
+						atomic.AddInt32(&exceeded, 1)
+					}
+					atomic.AddInt32(&held, -int32(n))
+					if err := sem.ReleaseN(n); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if exceeded != 0 {
+			t.Errorf("持有的单位数超过容量 %d 次", exceeded)
+		}
+		if !sem.TryAcquireN(10) {
+			t.Error("期望所有单位都被归还")
+		}
+	})
+}
+
+func TestConcurrency19SetLimit(t *testing.T) {
+	t.Run("扩容立即唤醒等待者", func(t *testing.T) {
+		sem := NewBoundedSemaphore(2)
+		sem.AcquireN(context.Background(), 2)
+
+		done := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				done <- sem.AcquireN(context.Background(), 1)
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		if stats := sem.Stats(); stats != (SemaphoreStats{Limit: 2, Held: 2, Waiters: 3}) {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+
+		sem.SetLimit(5)
+		for i := 0; i < 3; i++ {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("扩容之后等待者仍然阻塞")
+			}
+		}
+		if stats := sem.Stats(); stats != (SemaphoreStats{Limit: 5, Held: 5, Waiters: 0}) {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+
+	t.Run("缩容时已持有的单位不受影响", func(t *testing.T) {
+		sem := NewBoundedSemaphore(5)
+		sem.AcquireN(context.Background(), 4)
+		sem.SetLimit(2)
+
+		if stats := sem.Stats(); stats.Held != 4 || stats.Limit != 2 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+		if sem.TryAcquireN(1) {
+			t.Error("期望持有数超过新容量时拒绝获取")
+		}
+		// 归还到新容量以下之后才能再次获取
+		sem.ReleaseN(2)
+		if sem.TryAcquireN(1) {
+			t.Error("期望持有数等于新容量时拒绝获取")
+		}
+		sem.ReleaseN(1)
+		if !sem.TryAcquireN(1) {
+			t.Error("期望持有数低于新容量时获取成功")
+		}
+		if err := sem.AcquireN(context.Background(), 3); !errors.Is(err, ErrSemaphoreTooLarge) {
+			t.Errorf("期望返回 %v，实际 %v", ErrSemaphoreTooLarge, err)
+		}
+	})
+
+	t.Run("缩容唤醒永远无法满足的等待者", func(t *testing.T) {
+		sem := NewBoundedSemaphore(4)
+		sem.AcquireN(context.Background(), 1)
+
+		bigErr := make(chan error)
+		go func() {
+			bigErr <- sem.AcquireN(context.Background(), 4)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		smallErr := make(chan error)
+		go func() {
+			smallErr <- sem.AcquireN(context.Background(), 1)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		sem.SetLimit(2)
+		if err := <-bigErr; !errors.Is(err, ErrSemaphoreTooLarge) {
+			t.Errorf("期望返回 %v，实际 %v", ErrSemaphoreTooLarge, err)
+		}
+		if err := <-smallErr; err != nil {
+			t.Errorf("期望大请求被移除后小请求获取成功，实际返回 %v", err)
+		}
+		if stats := sem.Stats(); stats != (SemaphoreStats{Limit: 2, Held: 2, Waiters: 0}) {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+
+	t.Run("并发修改容量", func(t *testing.T) {
+		sem := NewBoundedSemaphore(4)
+
+		stop := make(chan struct{})
+		var resizer sync.WaitGroup
+		resizer.Add(1)
+		go func() {
+			defer resizer.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					sem.SetLimit(8)
+					return
+				default:
+				}
+				sem.SetLimit(i%8 + 1)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				n := id%2 + 1
+				for j := 0; j < 50; j++ {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+					err := sem.AcquireN(ctx, n)
+					cancel()
+					if err != nil {
+						continue
+					}
+					if err := sem.ReleaseN(n); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(stop)
+		resizer.Wait()
+
+		if stats := sem.Stats(); stats != (SemaphoreStats{Limit: 8, Held: 0, Waiters: 0}) {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+	t.Run("缩容时 Acquire 继续等待", func(t *testing.T) {
+		sem := NewBoundedSemaphore(1)
+		sem.Acquire()
+
+		var acquired int32
+		done := make(chan struct{})
+		go func() {
+			sem.Acquire()
+			atomic.StoreInt32(&acquired, 1)
+			close(done)
+		}()
+		tooLarge := make(chan error)
+		go func() {
+			tooLarge <- sem.AcquireN(context.Background(), 1)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		sem.SetLimit(0)
+		if err := <-tooLarge; !errors.Is(err, ErrSemaphoreTooLarge) {
+			t.Errorf("期望 AcquireN 返回 %v，实际 %v", ErrSemaphoreTooLarge, err)
+		}
+		sem.Release()
+		select {
+		case <-done:
+			t.Fatalf("期望容量为 0 时 Acquire 不返回，实际 %+v", sem.Stats())
+		case <-time.After(20 * time.Millisecond):
+		}
+		if stats := sem.Stats(); stats != (SemaphoreStats{Limit: 0, Held: 0, Waiters: 1}) {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+
+		sem.SetLimit(1)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("期望扩容之后 Acquire 获取成功")
+		}
+		if stats := sem.Stats(); atomic.LoadInt32(&acquired) != 1 || stats.Held != 1 {
+			t.Errorf("期望 Acquire 返回时持有 1 个单位，实际 %+v", stats)
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -8,53 +12,322 @@ import (
 )
 
 // 实现一个带超时功能的WorkPool，提交任务超时时放弃提交
+// 支持任务优先级：worker总是优先取高优先级队列中的任务，同时带有防饿死机制，保证低优先级任务也能被执行
+// 任务的错误和panic会被收集起来，通过Future等待单个任务的结果，通过Err获取所有任务的错误
+// worker数量可以在[minWorkers, maxWorkers]之间动态伸缩：没有空闲worker时扩容，空闲超时后缩容，也可以通过Resize手动调整
+// SubmitContext使用调用方的context限制提交等待时间，Shutdown超时后取消所有任务的context，不再等待正在执行的任务
+// 运行时指标通过Stats获取，见concurrency26_test.go
 //
-//
+
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	priorityLevels
+)
+
+var (
+	ErrWorkPoolClosed  = errors.New("work pool is closed")
+	ErrInvalidPriority = errors.New("invalid task priority")
+)
+
+// worker每连续取出agingInterval个任务，就反过来从低优先级开始取一次，防止低优先级任务被饿死
+const agingInterval = 8
 
 type WorkPool struct {
-	tasks        chan func() error
-	workers      uint32
+	queues       [priorityLevels]chan func() error
+	minWorkers   uint32
+	maxWorkers   uint32
+	running      uint32        // 当前存活的worker数量，由scaleMu保护
+	idle         atomic.Int32  // 正在阻塞等待任务的worker数量
+	idleTimeout  time.Duration // worker空闲超过该时间后退出（不少于minWorkers），为0时不缩容
+	scaleMu      *sync.Mutex
+	retire       chan struct{}   // Resize缩容时关闭该channel，唤醒空闲的worker检查是否需要退出
+	ctx          context.Context // 所有任务context的父context，Shutdown超时后被取消
+	cancel       context.CancelFunc
 	shutdown     chan struct{}
 	shutdownOnce *sync.Once
 	closed       atomic.Bool
 	taskOnce     *sync.Once
+	mu           *sync.RWMutex // 提交时持有读锁，关闭队列时持有写锁，避免向已关闭的channel发送数据
 	wg           *sync.WaitGroup
+	errMu        *sync.Mutex
+	errs         []error
+	metrics      *poolMetrics
+	laneMu       *sync.Mutex
+	lanes        map[string]*keyedLane // SubmitKeyed使用，见concurrency27_test.go
+	sched        *scheduler            // 延时和周期任务，见concurrency28_test.go
+}
+
+// PanicError 记录任务执行过程中发生的panic，避免worker goroutine崩溃
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panic: %v", e.Value)
+}
+
+// Future 表示一个已提交任务的执行结果，任务完成后Done返回的channel会被关闭
+type Future[T any] struct {
+	done   chan struct{}
+	result T
+	err    error
+}
+
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 阻塞直到任务执行完成，返回任务的结果和错误
+func (f *Future[T]) Wait() (T, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// safeCall 执行任务，并将panic转换为*PanicError返回
+func safeCall(task func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return task()
 }
 
 func NewWorkPool(workerNum, taskNum uint32) *WorkPool {
 	if workerNum <= 0 {
 		workerNum = 5
 	}
+	return NewDynamicWorkPool(workerNum, workerNum, taskNum, 0)
+}
+
+// NewDynamicWorkPool 创建一个worker数量在[minWorkers, maxWorkers]之间动态伸缩的WorkPool
+func NewDynamicWorkPool(minWorkers, maxWorkers, taskNum uint32, idleTimeout time.Duration) *WorkPool {
+	if minWorkers <= 0 {
+		minWorkers = 1
+	}
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
 	if taskNum <= 0 {
 		taskNum = 0
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	pool := &WorkPool{
-		tasks:        make(chan func() error, taskNum),
-		workers:      workerNum,
+		minWorkers:   minWorkers,
+		maxWorkers:   maxWorkers,
+		idleTimeout:  idleTimeout,
+		scaleMu:      new(sync.Mutex),
+		retire:       make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
 		shutdown:     make(chan struct{}),
 		shutdownOnce: new(sync.Once),
 		taskOnce:     new(sync.Once),
+		mu:           new(sync.RWMutex),
 		wg:           new(sync.WaitGroup),
+		errMu:        new(sync.Mutex),
+		metrics:      newPoolMetrics(),
+		laneMu:       new(sync.Mutex),
+		lanes:        make(map[string]*keyedLane),
+		sched:        newScheduler(),
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan func() error, taskNum)
 	}
 	pool.Start()
 	return pool
 }
 
 func (pool *WorkPool) Start() {
-	for i := 0; i < int(pool.workers); i++ {
-		pool.wg.Add(1)
-		go func() {
-			defer pool.wg.Done()
+	pool.scaleMu.Lock()
+	defer pool.scaleMu.Unlock()
+	for pool.running < pool.minWorkers {
+		pool.spawnLocked()
+	}
+}
+
+func (pool *WorkPool) spawnLocked() {
+	pool.running++
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+
+		queues := pool.queues // 每个worker持有一份拷贝，队列关闭后置为nil
+		served := 0
+		for {
+			task, ok := pool.next(&queues, &served)
+			if !ok {
+				return
+			}
+			if task != nil {
+				pool.record(safeCall(task))
+			}
+			if pool.tryRetire(false) {
+				return
+			}
+		}
+	}()
+}
+
+// grow 在没有空闲worker时增加一个worker，worker总数不会超过maxWorkers
+func (pool *WorkPool) grow() {
+	if pool.idle.Load() > 0 {
+		return
+	}
+	pool.scaleMu.Lock()
+	defer pool.scaleMu.Unlock()
+	if pool.running < pool.maxWorkers {
+		pool.spawnLocked()
+	}
+}
+
+// tryRetire 判断当前worker是否需要退出，需要退出时减少running计数
+// idle为true表示worker空闲超时，此时可以缩容到minWorkers，否则只在超过maxWorkers时退出
+func (pool *WorkPool) tryRetire(idle bool) bool {
+	pool.scaleMu.Lock()
+	defer pool.scaleMu.Unlock()
+	limit := pool.maxWorkers
+	if idle {
+		limit = pool.minWorkers
+	}
+	if pool.running > limit {
+		pool.running--
+		return true
+	}
+	return false
+}
+
+// Resize 在运行时调整worker数量的上下限，不足minWorkers时立即扩容，超过maxWorkers的worker在执行完当前任务后退出
+func (pool *WorkPool) Resize(minWorkers, maxWorkers uint32) bool {
+	if minWorkers <= 0 || maxWorkers < minWorkers {
+		return false
+	}
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed.Load() {
+		return false
+	}
+
+	pool.scaleMu.Lock()
+	defer pool.scaleMu.Unlock()
+	pool.minWorkers = minWorkers
+	pool.maxWorkers = maxWorkers
+	for pool.running < pool.minWorkers {
+		pool.spawnLocked()
+	}
+	if pool.running > pool.maxWorkers {
+		close(pool.retire)
+		pool.retire = make(chan struct{})
+	}
+	return true
+}
+
+// Workers 返回当前存活的worker数量
+func (pool *WorkPool) Workers() int {
+	pool.scaleMu.Lock()
+	defer pool.scaleMu.Unlock()
+	return int(pool.running)
+}
 
-			for task := range pool.tasks {
-				if task != nil {
-					_ = task()
+// next 按优先级从高到低取任务，返回false表示worker应该退出：所有队列都关闭且取空，或者被缩容
+func (pool *WorkPool) next(queues *[priorityLevels]chan func() error, served *int) (func() error, bool) {
+	order := [priorityLevels]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+	if *served >= agingInterval {
+		*served = 0
+		order = [priorityLevels]Priority{PriorityLow, PriorityNormal, PriorityHigh}
+	}
+	for {
+		open := false
+		for _, p := range order {
+			if queues[p] == nil {
+				continue
+			}
+			select {
+			case task, ok := <-queues[p]:
+				if !ok {
+					queues[p] = nil
+					continue
 				}
+				*served++
+				return task, true
+			default:
+				open = true
 			}
-		}()
+		}
+		if !open {
+			pool.scaleMu.Lock()
+			pool.running--
+			pool.scaleMu.Unlock()
+			return nil, false
+		}
+
+		// 所有队列暂时为空，阻塞等待任意一个队列有任务，或者空闲超时/被Resize唤醒
+		var timer *time.Timer
+		var idleC <-chan time.Time
+		if pool.idleTimeout > 0 {
+			timer = time.NewTimer(pool.idleTimeout)
+			idleC = timer.C
+		}
+		pool.scaleMu.Lock()
+		retire := pool.retire
+		pool.scaleMu.Unlock()
+
+		p := Priority(-1)
+		var task func() error
+		var ok, idle bool
+		pool.idle.Add(1)
+		select {
+		case task, ok = <-queues[PriorityHigh]:
+			p = PriorityHigh
+		case task, ok = <-queues[PriorityNormal]:
+			p = PriorityNormal
+		case task, ok = <-queues[PriorityLow]:
+			p = PriorityLow
+		case <-idleC:
+			idle = true
+		case <-retire:
+		}
+		pool.idle.Add(-1)
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if p < 0 {
+			if pool.tryRetire(idle) {
+				return nil, false
+			}
+			continue
+		}
+		if !ok {
+			queues[p] = nil
+			continue
+		}
+		*served++
+		return task, true
 	}
 }
 
+func (pool *WorkPool) record(err error) {
+	if err == nil {
+		return
+	}
+	pool.errMu.Lock()
+	pool.errs = append(pool.errs, err)
+	pool.errMu.Unlock()
+}
+
+// Err 返回所有任务执行失败的错误（包括panic），一般在Wait之后调用
+func (pool *WorkPool) Err() error {
+	pool.errMu.Lock()
+	defer pool.errMu.Unlock()
+	return errors.Join(pool.errs...)
+}
+
 func (pool *WorkPool) Close() {
 	pool.shutdownOnce.Do(func() {
 		pool.closed.Store(true)
@@ -63,28 +336,142 @@ func (pool *WorkPool) Close() {
 }
 
 func (pool *WorkPool) Submit(task func() error, timeout time.Duration) bool {
+	return pool.SubmitPriority(task, PriorityNormal, timeout)
+}
+
+// SubmitPriority 按指定优先级提交任务，超时或pool已关闭时返回false
+func (pool *WorkPool) SubmitPriority(task func() error, priority Priority, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return pool.enqueue(ctx, task, priority) == nil
+}
+
+// SubmitContext 提交一个可取消的任务，ctx限制提交时的等待时间，取消时返回ctx.Err()
+// 任务收到的context继承自ctx，并且在Shutdown超时后被取消，开始执行前context已经被取消的任务不会再执行
+func (pool *WorkPool) SubmitContext(ctx context.Context, task func(ctx context.Context) error) error {
+	taskCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(pool.ctx, cancel)
+	wrapped := func() error {
+		defer stop()
+		defer cancel()
+		if err := taskCtx.Err(); err != nil {
+			return err
+		}
+		if err := pool.ctx.Err(); err != nil { // AfterFunc异步取消taskCtx，这里同步检查一次pool是否已经被取消
+			return err
+		}
+		return task(taskCtx)
+	}
+	if err := pool.enqueue(ctx, wrapped, PriorityNormal); err != nil {
+		stop()
+		cancel()
+		return err
+	}
+	return nil
+}
+
+func (pool *WorkPool) enqueue(ctx context.Context, task func() error, priority Priority) error {
+	if priority < PriorityHigh || priority >= priorityLevels {
+		return ErrInvalidPriority
+	}
+	pool.metrics.submitted()
+	enqueued := time.Now()
+	wrapped := func() error {
+		started := pool.metrics.start(enqueued)
+		err := safeCall(task)
+		pool.metrics.finish(started, err)
+		return err
+	}
+	if err := pool.send(ctx, wrapped, priority); err != nil {
+		pool.metrics.rejected(err)
+		return err
+	}
+	return nil
+}
+
+// send 把任务放入对应优先级的队列，不记录指标
+func (pool *WorkPool) send(ctx context.Context, task func() error, priority Priority) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
 	if pool.closed.Load() {
-		return false
+		return ErrWorkPoolClosed
 	}
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+	pool.grow()
 
 	select {
-	case <-timer.C:
-		return false
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-pool.shutdown:
-		return false
-	case pool.tasks <- task:
-		return true
+		return ErrWorkPoolClosed
+	case pool.queues[priority] <- task:
+		return nil
+	}
+}
+
+// Stats 返回当前的指标快照
+func (pool *WorkPool) Stats() PoolStats {
+	return pool.metrics.snapshot()
+}
+
+// SetHook 设置指标回调，传入nil表示取消
+func (pool *WorkPool) SetHook(hook PoolHook) {
+	pool.metrics.setHook(hook)
+}
+
+// SubmitFuture 提交一个带返回值的任务，提交成功时返回可以等待结果的Future
+// Go的方法不支持类型参数，所以这里使用泛型函数
+func SubmitFuture[T any](pool *WorkPool, task func() (T, error), priority Priority, timeout time.Duration) (*Future[T], bool) {
+	f := &Future[T]{done: make(chan struct{})}
+	wrapped := func() error {
+		defer close(f.done)
+		f.err = safeCall(func() error {
+			var err error
+			f.result, err = task()
+			return err
+		})
+		return f.err
+	}
+	if !pool.SubmitPriority(wrapped, priority, timeout) {
+		return nil, false
 	}
+	return f, true
 }
 
 func (pool *WorkPool) Wait() {
 	pool.Close()
+	pool.closeQueues()
+	pool.wg.Wait()
+	pool.cancel()
+}
+
+// Shutdown 停止接收新任务并等待已提交的任务执行完成
+// ctx结束时取消所有任务的context并立即返回ctx.Err()，不再等待仍在执行的任务
+func (pool *WorkPool) Shutdown(ctx context.Context) error {
+	pool.Close()
+	pool.closeQueues()
+	done := make(chan struct{})
+	go func() {
+		pool.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		pool.cancel()
+		return nil
+	case <-ctx.Done():
+		pool.cancel()
+		return ctx.Err()
+	}
+}
+
+func (pool *WorkPool) closeQueues() {
 	pool.taskOnce.Do(func() {
-		close(pool.tasks)
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		for _, q := range pool.queues {
+			close(q)
+		}
 	})
-	pool.wg.Wait()
 }
 
 func TestConcurrency20(t *testing.T) {
@@ -291,6 +678,112 @@ func TestConcurrency20(t *testing.T) {
 		} else {
 			t.Logf("Worker 数量限制正确：最大并发数 %d <= %d", maxActive, maxWorkers)
 		}
+
+		// 动态伸缩的 pool 在扩容过程中同样不能超过 maxWorkers
+		dynamic := NewDynamicWorkPool(1, uint32(maxWorkers), 10, 20*time.Millisecond)
+		defer dynamic.Wait()
+
+		atomic.StoreInt32(&maxActive, 0)
+		var maxSeen int
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			task := func() error {
+				defer wg.Done()
+				current := atomic.AddInt32(&activeWorkers, 1)
+				for {
+					max := atomic.LoadInt32(&maxActive)
+					if current <= max || atomic.CompareAndSwapInt32(&maxActive, max, current) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&activeWorkers, -1)
+				return nil
+			}
+			dynamic.Submit(task, time.Second)
+			if n := dynamic.Workers(); n > maxSeen {
+				maxSeen = n
+			}
+		}
+
+		wg.Wait()
+
+		if maxActive > int32(maxWorkers) || maxSeen > maxWorkers {
+			t.Errorf("期望扩容时最多 %d 个 worker，但观察到并发 %d 个、存活 %d 个", maxWorkers, maxActive, maxSeen)
+		} else if maxSeen < 2 {
+			t.Errorf("期望任务积压时扩容，但 worker 数量一直是 %d", maxSeen)
+		} else {
+			t.Logf("动态扩容上限正确：最大并发数 %d，最多存活 %d 个 worker", maxActive, maxSeen)
+		}
+	})
+
+	t.Run("空闲缩容测试", func(t *testing.T) {
+		pool := NewDynamicWorkPool(1, 4, 10, 20*time.Millisecond)
+		defer pool.Wait()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			pool.Submit(func() error {
+				defer wg.Done()
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			}, time.Second)
+		}
+		wg.Wait()
+		if n := pool.Workers(); n < 2 {
+			t.Errorf("期望任务积压时扩容，实际 worker 数量 %d", n)
+		}
+
+		// 等待空闲超时，多余的 worker 应该退出，只保留 minWorkers 个
+		time.Sleep(100 * time.Millisecond)
+		if n := pool.Workers(); n != 1 {
+			t.Errorf("期望空闲后缩容到 1 个 worker，实际 %d 个", n)
+		} else {
+			t.Log("空闲缩容到 minWorkers，符合预期")
+		}
+	})
+
+	t.Run("Resize 手动调整测试", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+
+		if !pool.Resize(5, 5) {
+			t.Fatal("Resize 失败")
+		}
+		if n := pool.Workers(); n != 5 {
+			t.Errorf("期望扩容到 5 个 worker，实际 %d 个", n)
+		}
+
+		// 缩容时正在执行任务的 worker 先完成任务再退出
+		var counter int32
+		blockChan := make(chan struct{})
+		for i := 0; i < 5; i++ {
+			pool.Submit(func() error {
+				<-blockChan
+				atomic.AddInt32(&counter, 1)
+				return nil
+			}, time.Second)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if !pool.Resize(1, 2) {
+			t.Fatal("Resize 失败")
+		}
+		close(blockChan)
+		time.Sleep(20 * time.Millisecond)
+		if n := pool.Workers(); n != 2 {
+			t.Errorf("期望缩容到 2 个 worker，实际 %d 个", n)
+		}
+
+		if pool.Resize(3, 1) {
+			t.Error("期望拒绝 minWorkers > maxWorkers 的 Resize")
+		}
+		pool.Wait()
+		if pool.Resize(1, 1) {
+			t.Error("期望关闭后拒绝 Resize")
+		}
+		if counter != 5 {
+			t.Errorf("期望执行 5 个任务，实际执行了 %d 个", counter)
+		}
 	})
 
 	t.Run("队列满时超时测试", func(t *testing.T) {
@@ -353,4 +846,279 @@ func TestConcurrency20(t *testing.T) {
 			t.Logf("Wait 正确等待所有任务完成，耗时 %v", duration)
 		}
 	})
+
+	t.Run("优先级调度测试", func(t *testing.T) {
+		pool := NewWorkPool(1, 10)
+
+		// 阻塞唯一的 worker，让任务在各优先级队列中排队
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+		time.Sleep(10 * time.Millisecond)
+
+		var mu sync.Mutex
+		var order []Priority
+		record := func(p Priority) func() error {
+			return func() error {
+				mu.Lock()
+				order = append(order, p)
+				mu.Unlock()
+				return nil
+			}
+		}
+		for _, p := range []Priority{PriorityLow, PriorityLow, PriorityNormal, PriorityNormal, PriorityHigh, PriorityHigh} {
+			if !pool.SubmitPriority(record(p), p, time.Second) {
+				t.Fatalf("优先级 %d 的任务提交失败", p)
+			}
+		}
+
+		close(blockChan)
+		pool.Wait()
+
+		expected := []Priority{PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow, PriorityLow}
+		for i := range expected {
+			if order[i] != expected[i] {
+				t.Fatalf("期望执行顺序 %v，实际 %v", expected, order)
+			}
+		}
+		t.Logf("高优先级任务优先执行：%v", order)
+	})
+
+	t.Run("低优先级防饿死测试", func(t *testing.T) {
+		pool := NewWorkPool(1, 100)
+
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+		time.Sleep(10 * time.Millisecond)
+
+		var executed int32
+		var lowAt int32 = -1
+		pool.SubmitPriority(func() error {
+			atomic.StoreInt32(&lowAt, atomic.AddInt32(&executed, 1))
+			return nil
+		}, PriorityLow, time.Second)
+		for i := 0; i < 50; i++ {
+			pool.SubmitPriority(func() error {
+				atomic.AddInt32(&executed, 1)
+				return nil
+			}, PriorityHigh, time.Second)
+		}
+
+		close(blockChan)
+		pool.Wait()
+
+		// 阻塞任务占用了一次计数，之后最多再连续执行 agingInterval 个高优先级任务就会轮到低优先级任务
+		if lowAt < 0 || lowAt > agingInterval+1 {
+			t.Errorf("低优先级任务在第 %d 个才执行，期望不晚于第 %d 个", lowAt, agingInterval+1)
+		} else {
+			t.Logf("低优先级任务在第 %d 个执行，没有被饿死", lowAt)
+		}
+	})
+
+	t.Run("各优先级关闭后拒绝并排空", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+
+		var counter int32
+		task := func() error {
+			atomic.AddInt32(&counter, 1)
+			time.Sleep(time.Millisecond)
+			return nil
+		}
+		for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+			for i := 0; i < 5; i++ {
+				if !pool.SubmitPriority(task, p, time.Second) {
+					t.Errorf("优先级 %d 的任务提交失败", p)
+				}
+			}
+		}
+
+		pool.Close()
+		for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+			if pool.SubmitPriority(task, p, time.Second) {
+				t.Errorf("期望关闭后拒绝优先级 %d 的任务，但实际接受了", p)
+			}
+		}
+		if pool.SubmitPriority(task, priorityLevels, time.Second) {
+			t.Errorf("期望拒绝非法优先级的任务，但实际接受了")
+		}
+
+		pool.Wait()
+		if counter != 15 {
+			t.Errorf("期望执行 15 个任务，实际执行了 %d 个", counter)
+		}
+	})
+
+	t.Run("Future 获取任务结果和错误", func(t *testing.T) {
+		pool := NewWorkPool(3, 10)
+
+		ok, submitted := SubmitFuture(pool, func() (int, error) {
+			return 42, nil
+		}, PriorityNormal, time.Second)
+		if !submitted {
+			t.Fatal("任务提交失败")
+		}
+		errTask := errors.New("task failed")
+		failed, submitted := SubmitFuture(pool, func() (string, error) {
+			return "", errTask
+		}, PriorityHigh, time.Second)
+		if !submitted {
+			t.Fatal("任务提交失败")
+		}
+
+		if val, err := ok.Wait(); err != nil || val != 42 {
+			t.Errorf("期望得到 (42, nil)，实际得到 (%d, %v)", val, err)
+		}
+		if _, err := failed.Wait(); !errors.Is(err, errTask) {
+			t.Errorf("期望得到错误 %v，实际得到 %v", errTask, err)
+		}
+
+		pool.Wait()
+		if err := pool.Err(); !errors.Is(err, errTask) {
+			t.Errorf("期望 pool 汇总的错误包含 %v，实际得到 %v", errTask, err)
+		}
+	})
+
+	t.Run("任务 panic 被捕获", func(t *testing.T) {
+		pool := NewWorkPool(1, 10)
+
+		f, _ := SubmitFuture(pool, func() (int, error) {
+			panic("boom")
+		}, PriorityNormal, time.Second)
+		pool.Submit(func() error {
+			panic("boom again")
+		}, time.Second)
+
+		// 唯一的 worker 在 panic 之后应该还能继续执行任务
+		var counter int32
+		pool.Submit(func() error {
+			atomic.AddInt32(&counter, 1)
+			return nil
+		}, time.Second)
+
+		_, err := f.Wait()
+		var pe *PanicError
+		if !errors.As(err, &pe) || pe.Value != "boom" {
+			t.Errorf("期望得到 PanicError(boom)，实际得到 %v", err)
+		}
+
+		pool.Wait()
+		if counter != 1 {
+			t.Errorf("期望 panic 之后 worker 继续执行任务，实际执行了 %d 个", counter)
+		}
+		if joined, ok := pool.Err().(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 2 {
+			t.Errorf("期望 pool 汇总 2 个 panic 错误，实际得到 %v", pool.Err())
+		}
+	})
+
+	t.Run("没有失败任务时 Err 为 nil", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+		for i := 0; i < 5; i++ {
+			pool.Submit(func() error { return nil }, time.Second)
+		}
+		pool.Wait()
+		if err := pool.Err(); err != nil {
+			t.Errorf("期望 Err 为 nil，实际得到 %v", err)
+		}
+	})
+
+	t.Run("SubmitContext 提交等待受 ctx 限制", func(t *testing.T) {
+		pool := NewWorkPool(1, 0)
+
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := pool.SubmitContext(ctx, func(ctx context.Context) error {
+			t.Error("这个任务不应该被执行")
+			return nil
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望提交超时返回 %v，实际返回 %v", context.DeadlineExceeded, err)
+		}
+
+		close(blockChan)
+		pool.Wait()
+		if err := pool.SubmitContext(context.Background(), func(ctx context.Context) error { return nil }); !errors.Is(err, ErrWorkPoolClosed) {
+			t.Errorf("期望关闭后返回 %v，实际返回 %v", ErrWorkPoolClosed, err)
+		}
+	})
+
+	t.Run("Shutdown 超时取消正在执行的任务", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+
+		var cancelled int32
+		for i := 0; i < 2; i++ {
+			err := pool.SubmitContext(context.Background(), func(ctx context.Context) error {
+				<-ctx.Done()
+				atomic.AddInt32(&cancelled, 1)
+				return ctx.Err()
+			})
+			if err != nil {
+				t.Fatalf("任务提交失败: %v", err)
+			}
+		}
+		// 排队中的任务在 context 取消后不会再执行
+		var started int32
+		for i := 0; i < 3; i++ {
+			pool.SubmitContext(context.Background(), func(ctx context.Context) error {
+				atomic.AddInt32(&started, 1)
+				return nil
+			})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := pool.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望 Shutdown 返回 %v，实际返回 %v", context.DeadlineExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("Shutdown 没有在 deadline 后及时返回，耗时 %v", elapsed)
+		}
+
+		pool.Wait()
+		if cancelled != 2 {
+			t.Errorf("期望 2 个任务收到取消信号，实际 %d 个", cancelled)
+		}
+		if started != 0 {
+			t.Errorf("期望排队中的任务不再执行，实际执行了 %d 个", started)
+		}
+		if err := pool.Err(); !errors.Is(err, context.Canceled) {
+			t.Errorf("期望 pool 汇总的错误包含 %v，实际得到 %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("Shutdown 等待任务正常完成", func(t *testing.T) {
+		pool := NewWorkPool(3, 10)
+
+		var counter int32
+		for i := 0; i < 6; i++ {
+			pool.SubmitContext(context.Background(), func(ctx context.Context) error {
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&counter, 1)
+				return ctx.Err()
+			})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := pool.Shutdown(ctx); err != nil {
+			t.Errorf("期望 Shutdown 返回 nil，实际返回 %v", err)
+		}
+		if counter != 6 {
+			t.Errorf("期望执行 6 个任务，实际执行了 %d 个", counter)
+		}
+		if err := pool.Err(); err != nil {
+			t.Errorf("期望任务都没有被取消，实际得到 %v", err)
+		}
+	})
 }
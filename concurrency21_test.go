@@ -8,34 +8,107 @@ import (
 )
 
 // 实现一个线程安全的队列
+//
+// 默认不限制长度，Push总是直接追加；生产者比消费者快时内存会无限增长，
+// 这时可以用NewBoundedQueue限制容量：队列满时Push阻塞，直到Pop取走元素，把压力传递给生产者
+// 队列空和队列满分别使用一个sync.Cond等待，Pop只唤醒等待的生产者，Push只唤醒等待的消费者
 type Queue[T any] struct {
-	items []T
-	mu    *sync.Mutex
-	cond  *sync.Cond
+	items    []T
+	capacity int // 0表示不限制长度
+	mu       *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
 }
 
 func NewQueue[T any]() *Queue[T] {
 	q := &Queue[T]{}
 	q.mu = new(sync.Mutex)
-	q.cond = sync.NewCond(q.mu)
+	q.notEmpty = sync.NewCond(q.mu)
+	q.notFull = sync.NewCond(q.mu)
 	return q
 }
 
+// NewBoundedQueue 创建最多容纳capacity个元素的队列，capacity<=0表示不限制长度
+func NewBoundedQueue[T any](capacity int) *Queue[T] {
+	q := NewQueue[T]()
+	if capacity > 0 {
+		q.capacity = capacity
+		q.items = make([]T, 0, capacity)
+	}
+	return q
+}
+
+// Push 把元素加入队尾，队列满时阻塞
 func (q *Queue[T]) Push(item T) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	q.items = append(q.items, item)
-	q.cond.Signal()
+	for q.fullLocked() {
+		q.notFull.Wait()
+	}
+	q.pushLocked(item)
+}
+
+// TryPush 队列没满时加入元素并返回true，否则直接返回false
+func (q *Queue[T]) TryPush(item T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.fullLocked() {
+		return false
+	}
+	q.pushLocked(item)
+	return true
 }
 
+// Pop 取出队首的元素，队列空时阻塞
 func (q *Queue[T]) Pop() T {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	for len(q.items) == 0 {
-		q.cond.Wait() // 陷入阻塞并释放锁
+		q.notEmpty.Wait() // 陷入阻塞并释放锁
 	}
+	return q.popLocked()
+}
+
+// TryPop 队列不空时取出队首的元素并返回true，否则直接返回false
+func (q *Queue[T]) TryPop() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	return q.popLocked(), true
+}
+
+// Len 返回队列中的元素数量
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Cap 返回队列的容量，0表示不限制长度
+func (q *Queue[T]) Cap() int {
+	return q.capacity
+}
+
+func (q *Queue[T]) fullLocked() bool {
+	return q.capacity > 0 && len(q.items) >= q.capacity
+}
+
+func (q *Queue[T]) pushLocked(item T) {
+	q.items = append(q.items, item)
+	q.notEmpty.Signal()
+}
+
+func (q *Queue[T]) popLocked() T {
 	item := q.items[0]
+	var zero T
+	q.items[0] = zero // 避免底层数组继续引用已经取出的元素
 	q.items = q.items[1:]
+	if q.capacity > 0 {
+		q.notFull.Signal()
+	}
 	return item
 }
 
@@ -464,3 +537,120 @@ func TestConcurrency21(t *testing.T) {
 		t.Log("零值类型测试通过")
 	})
 }
+
+func TestConcurrency21Bounded(t *testing.T) {
+	t.Run("容量和长度", func(t *testing.T) {
+		if q := NewQueue[int](); q.Cap() != 0 {
+			t.Errorf("期望不限制长度的队列容量为 0，实际 %d", q.Cap())
+		}
+		if q := NewBoundedQueue[int](0); q.Cap() != 0 {
+			t.Errorf("期望 capacity<=0 时不限制长度，实际 %d", q.Cap())
+		}
+
+		q := NewBoundedQueue[int](3)
+		if q.Cap() != 3 || q.Len() != 0 {
+			t.Errorf("期望容量 3 长度 0，实际 %d, %d", q.Cap(), q.Len())
+		}
+		q.Push(1)
+		q.Push(2)
+		if n := q.Len(); n != 2 {
+			t.Errorf("期望长度 2，实际 %d", n)
+		}
+	})
+
+	t.Run("TryPush 和 TryPop", func(t *testing.T) {
+		q := NewBoundedQueue[int](2)
+		if _, ok := q.TryPop(); ok {
+			t.Error("期望空队列 TryPop 返回 false")
+		}
+		if !q.TryPush(1) || !q.TryPush(2) {
+			t.Error("期望队列没满时 TryPush 成功")
+		}
+		if q.TryPush(3) {
+			t.Error("期望队列满时 TryPush 返回 false")
+		}
+		if val, ok := q.TryPop(); !ok || val != 1 {
+			t.Errorf("期望 TryPop 得到 1，实际 %d, %v", val, ok)
+		}
+		if !q.TryPush(3) {
+			t.Error("期望取出元素之后 TryPush 成功")
+		}
+		for _, want := range []int{2, 3} {
+			if val := q.Pop(); val != want {
+				t.Errorf("期望 Pop 得到 %d，实际 %d", want, val)
+			}
+		}
+	})
+
+	t.Run("队列满时 Push 阻塞", func(t *testing.T) {
+		q := NewBoundedQueue[int](2)
+		q.Push(1)
+		q.Push(2)
+
+		pushed := make(chan struct{})
+		go func() {
+			q.Push(3)
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			t.Fatal("期望队列满时 Push 阻塞")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if val := q.Pop(); val != 1 {
+			t.Errorf("期望 Pop 得到 1，实际 %d", val)
+		}
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatal("期望 Pop 之后阻塞的 Push 被唤醒")
+		}
+		for _, want := range []int{2, 3} {
+			if val := q.Pop(); val != want {
+				t.Errorf("期望 Pop 得到 %d，实际 %d", want, val)
+			}
+		}
+	})
+
+	t.Run("快生产者慢消费者不超过容量", func(t *testing.T) {
+		const capacity = 8
+		q := NewBoundedQueue[int](capacity)
+		producers := 4
+		itemsPerProducer := 200
+		totalItems := producers * itemsPerProducer
+
+		var wg sync.WaitGroup
+		for i := 0; i < producers; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for j := 0; j < itemsPerProducer; j++ {
+					q.Push(id*itemsPerProducer + j)
+				}
+			}(i)
+		}
+
+		seen := make(map[int]bool, totalItems)
+		maxLen := 0
+		for i := 0; i < totalItems; i++ {
+			if n := q.Len(); n > maxLen {
+				maxLen = n
+			}
+			seen[q.Pop()] = true
+			if i%50 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		wg.Wait()
+
+		if maxLen > capacity {
+			t.Errorf("期望队列长度不超过 %d，实际最大 %d", capacity, maxLen)
+		}
+		if len(seen) != totalItems {
+			t.Errorf("期望收到 %d 个不同的元素，实际 %d 个", totalItems, len(seen))
+		}
+		t.Logf("队列最大长度 %d", maxLen)
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 为Pool和WorkPool增加运行时指标，通过Stats()获取快照：
+// 排队中、执行中、已完成、失败、被拒绝（队列满/已关闭/超时/取消）的任务数量，以及排队等待时间和执行时间的直方图
+// 同时支持注册PoolHook，把这些指标导出到自己的监控系统
+
+// PoolHook 在任务生命周期的各个阶段被调用，实现需要是并发安全的，并且不应该阻塞
+// 每次提交都会调用OnSubmit，之后要么调用OnReject，要么依次调用OnStart和OnFinish
+type PoolHook interface {
+	OnSubmit()
+	OnReject(err error)
+	OnStart(wait time.Duration)
+	OnFinish(exec time.Duration, err error)
+}
+
+// 直方图各个桶的上界，最后还有一个容纳更大值的桶
+var defaultLatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram 是耗时直方图的快照，Counts[i]表示耗时<=Buckets[i]的次数，最后一个元素表示超过所有上界的次数
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{
+		Buckets: defaultLatencyBuckets,
+		Counts:  make([]uint64, len(defaultLatencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Buckets) && d > h.Buckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h LatencyHistogram) clone() LatencyHistogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// Mean 返回平均耗时
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// PoolStats 是某一时刻的指标快照
+type PoolStats struct {
+	Queued          int64
+	Running         int64
+	Completed       uint64
+	Failed          uint64
+	RejectedFull    uint64
+	RejectedClosed  uint64
+	RejectedTimeout uint64
+	// RejectedCanceled 统计提交者主动放弃的任务（context被取消），无法归类的错误也计入这里
+	RejectedCanceled uint64
+	QueueWait        LatencyHistogram
+	ExecTime         LatencyHistogram
+}
+
+type hookBox struct {
+	hook PoolHook
+}
+
+// poolMetrics 负责记录指标，Pool和WorkPool在提交、开始、结束任务时调用
+type poolMetrics struct {
+	queued           atomic.Int64
+	running          atomic.Int64
+	completed        atomic.Uint64
+	failed           atomic.Uint64
+	rejectedFull     atomic.Uint64
+	rejectedClosed   atomic.Uint64
+	rejectedTimeout  atomic.Uint64
+	rejectedCanceled atomic.Uint64
+
+	mu        sync.Mutex
+	queueWait LatencyHistogram
+	execTime  LatencyHistogram
+
+	hook atomic.Pointer[hookBox]
+}
+
+func newPoolMetrics() *poolMetrics {
+	return &poolMetrics{
+		queueWait: newLatencyHistogram(),
+		execTime:  newLatencyHistogram(),
+	}
+}
+
+func (m *poolMetrics) setHook(hook PoolHook) {
+	if hook == nil {
+		m.hook.Store(nil)
+		return
+	}
+	m.hook.Store(&hookBox{hook: hook})
+}
+
+func (m *poolMetrics) loadHook() PoolHook {
+	if box := m.hook.Load(); box != nil {
+		return box.hook
+	}
+	return nil
+}
+
+// submitted 在每次提交时调用，先把任务计入排队数量，入队失败时调用rejected撤销
+func (m *poolMetrics) submitted() {
+	m.queued.Add(1)
+	if hook := m.loadHook(); hook != nil {
+		hook.OnSubmit()
+	}
+}
+
+// rejected 按错误类型统计被拒绝的任务
+func (m *poolMetrics) rejected(err error) {
+	m.queued.Add(-1)
+	switch {
+	case errors.Is(err, ErrPoolFull):
+		m.rejectedFull.Add(1)
+	case errors.Is(err, ErrPoolClosed), errors.Is(err, ErrWorkPoolClosed):
+		m.rejectedClosed.Add(1)
+	case errors.Is(err, ErrPoolTimeout), errors.Is(err, context.DeadlineExceeded):
+		m.rejectedTimeout.Add(1)
+	default:
+		m.rejectedCanceled.Add(1)
+	}
+	if hook := m.loadHook(); hook != nil {
+		hook.OnReject(err)
+	}
+}
+
+// start 在worker开始执行任务时调用，返回开始执行的时间
+func (m *poolMetrics) start(enqueued time.Time) time.Time {
+	now := time.Now()
+	wait := now.Sub(enqueued)
+	m.queued.Add(-1)
+	m.running.Add(1)
+	m.mu.Lock()
+	m.queueWait.observe(wait)
+	m.mu.Unlock()
+	if hook := m.loadHook(); hook != nil {
+		hook.OnStart(wait)
+	}
+	return now
+}
+
+func (m *poolMetrics) finish(started time.Time, err error) {
+	exec := time.Since(started)
+	m.running.Add(-1)
+	if err != nil {
+		m.failed.Add(1)
+	} else {
+		m.completed.Add(1)
+	}
+	m.mu.Lock()
+	m.execTime.observe(exec)
+	m.mu.Unlock()
+	if hook := m.loadHook(); hook != nil {
+		hook.OnFinish(exec, err)
+	}
+}
+
+func (m *poolMetrics) snapshot() PoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return PoolStats{
+		Queued:           m.queued.Load(),
+		Running:          m.running.Load(),
+		Completed:        m.completed.Load(),
+		Failed:           m.failed.Load(),
+		RejectedFull:     m.rejectedFull.Load(),
+		RejectedClosed:   m.rejectedClosed.Load(),
+		RejectedTimeout:  m.rejectedTimeout.Load(),
+		RejectedCanceled: m.rejectedCanceled.Load(),
+		QueueWait:        m.queueWait.clone(),
+		ExecTime:         m.execTime.clone(),
+	}
+}
+
+// countingHook 统计各个回调被调用的次数
+type countingHook struct {
+	submit, reject, start, finish atomic.Int32
+}
+
+func (h *countingHook) OnSubmit()                     { h.submit.Add(1) }
+func (h *countingHook) OnReject(error)                { h.reject.Add(1) }
+func (h *countingHook) OnStart(time.Duration)         { h.start.Add(1) }
+func (h *countingHook) OnFinish(time.Duration, error) { h.finish.Add(1) }
+
+func TestConcurrency26(t *testing.T) {
+	t.Run("Pool 统计与拒绝原因", func(t *testing.T) {
+		pool := NewPool(1, 1)
+		hook := &countingHook{}
+		pool.SetHook(hook)
+
+		blockChan := make(chan struct{})
+		started := make(chan struct{})
+		pool.Submit(func() {
+			close(started)
+			<-blockChan
+		})
+		<-started
+		if err := pool.Submit(func() {}); err != nil {
+			t.Fatalf("任务提交失败: %v", err)
+		}
+		if err := pool.Submit(func() {}); !errors.Is(err, ErrPoolFull) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolFull, err)
+		}
+
+		stats := pool.Stats()
+		if stats.Running != 1 || stats.Queued != 1 || stats.RejectedFull != 1 {
+			t.Errorf("期望 running=1 queued=1 rejectedFull=1，实际 %+v", stats)
+		}
+
+		close(blockChan)
+		pool.Shutdown()
+		if err := pool.Submit(func() {}); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("期望返回 %v，实际返回 %v", ErrPoolClosed, err)
+		}
+
+		stats = pool.Stats()
+		if stats.Completed != 2 || stats.Queued != 0 || stats.Running != 0 || stats.RejectedClosed != 1 {
+			t.Errorf("期望 completed=2 queued=0 running=0 rejectedClosed=1，实际 %+v", stats)
+		}
+		if stats.QueueWait.Count != 2 || stats.ExecTime.Count != 2 {
+			t.Errorf("期望直方图各记录 2 次，实际 %d/%d", stats.QueueWait.Count, stats.ExecTime.Count)
+		}
+		if hook.submit.Load() != 4 || hook.reject.Load() != 2 || hook.start.Load() != 2 || hook.finish.Load() != 2 {
+			t.Errorf("hook 调用次数不符合预期: submit=%d reject=%d start=%d finish=%d",
+				hook.submit.Load(), hook.reject.Load(), hook.start.Load(), hook.finish.Load())
+		}
+	})
+
+	t.Run("WorkPool 统计成功失败和超时", func(t *testing.T) {
+		pool := NewWorkPool(1, 0)
+
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+		if pool.Submit(func() error { return nil }, 10*time.Millisecond) {
+			t.Fatal("期望任务提交超时")
+		}
+		close(blockChan)
+
+		pool.Submit(func() error { return errors.New("failed") }, time.Second)
+		pool.SubmitContext(context.Background(), func(ctx context.Context) error {
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		})
+		pool.Wait()
+		pool.Submit(func() error { return nil }, time.Second)
+
+		stats := pool.Stats()
+		if stats.Completed != 2 || stats.Failed != 1 {
+			t.Errorf("期望 completed=2 failed=1，实际 %+v", stats)
+		}
+		if stats.RejectedTimeout != 1 || stats.RejectedClosed != 1 {
+			t.Errorf("期望 rejectedTimeout=1 rejectedClosed=1，实际 %+v", stats)
+		}
+		if stats.Queued != 0 || stats.Running != 0 {
+			t.Errorf("期望结束后 queued=0 running=0，实际 %+v", stats)
+		}
+		if stats.ExecTime.Count != 3 || stats.ExecTime.Mean() <= 0 {
+			t.Errorf("期望执行时间直方图记录 3 次，实际 %+v", stats.ExecTime)
+		}
+	})
+
+	t.Run("取消提交计入 canceled 而不是 timeout", func(t *testing.T) {
+		pool := NewWorkPool(1, 0)
+		defer pool.Close()
+
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := pool.SubmitContext(ctx, func(ctx context.Context) error { return nil }); !errors.Is(err, context.Canceled) {
+			t.Errorf("期望返回 %v，实际返回 %v", context.Canceled, err)
+		}
+		close(blockChan)
+
+		stats := pool.Stats()
+		if stats.RejectedCanceled != 1 || stats.RejectedTimeout != 0 {
+			t.Errorf("期望 rejectedCanceled=1 rejectedTimeout=0，实际 %+v", stats)
+		}
+	})
+
+	t.Run("直方图分桶", func(t *testing.T) {
+		h := newLatencyHistogram()
+		h.observe(50 * time.Microsecond)
+		h.observe(5 * time.Millisecond)
+		h.observe(time.Minute)
+
+		if h.Counts[0] != 1 || h.Counts[2] != 1 || h.Counts[len(h.Counts)-1] != 1 {
+			t.Errorf("分桶结果不符合预期: %v", h.Counts)
+		}
+		if h.Count != 3 {
+			t.Errorf("期望记录 3 次，实际 %d 次", h.Count)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 为WorkPool实现按key有序执行：相同key的任务按提交顺序串行执行，不同key的任务仍然可以在多个worker上并行执行
+// 类似concurrency1/concurrency2中每个goroutine一个channel来保证打印顺序，这里把它抽象成可复用的组件
+//
+// 每个key对应一条lane，lane中排队的任务由一个提交到WorkPool的drain任务依次执行，执行完后删除lane
+// 这样不会长期占用worker，也不需要在worker中再次提交任务（队列满时可能死锁）
+
+type keyedTask struct {
+	fn       func() error
+	enqueued time.Time
+}
+
+type keyedLane struct {
+	tasks   []keyedTask
+	pending chan struct{} // 不为nil表示drain任务还在入队，期间其他提交者需要等待入队结果
+}
+
+// SubmitKeyed 提交一个带key的任务，相同key的任务按提交顺序依次执行
+// 超时或者pool已关闭时返回false
+func (pool *WorkPool) SubmitKeyed(key string, task func() error, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pool.metrics.submitted()
+	t := keyedTask{fn: task, enqueued: time.Now()}
+	for {
+		if pool.closed.Load() {
+			pool.metrics.rejected(ErrWorkPoolClosed)
+			return false
+		}
+
+		pool.laneMu.Lock()
+		lane, ok := pool.lanes[key]
+		if !ok {
+			break // 持有laneMu跳出循环，由当前提交者创建lane
+		}
+		if lane.pending == nil {
+			lane.tasks = append(lane.tasks, t)
+			pool.laneMu.Unlock()
+			return true
+		}
+		pending := lane.pending
+		pool.laneMu.Unlock()
+
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			pool.metrics.rejected(ctx.Err())
+			return false
+		}
+	}
+
+	lane := &keyedLane{tasks: []keyedTask{t}, pending: make(chan struct{})}
+	pool.lanes[key] = lane
+	pool.laneMu.Unlock()
+
+	err := pool.send(ctx, func() error {
+		pool.drainLane(key, lane)
+		return nil
+	}, PriorityNormal)
+
+	pool.laneMu.Lock()
+	if err != nil {
+		delete(pool.lanes, key)
+	}
+	close(lane.pending)
+	lane.pending = nil
+	pool.laneMu.Unlock()
+
+	if err != nil {
+		pool.metrics.rejected(err)
+		return false
+	}
+	return true
+}
+
+// drainLane 依次执行lane中的任务，直到lane为空
+func (pool *WorkPool) drainLane(key string, lane *keyedLane) {
+	for {
+		pool.laneMu.Lock()
+		if len(lane.tasks) == 0 {
+			if pool.lanes[key] == lane {
+				delete(pool.lanes, key)
+			}
+			pool.laneMu.Unlock()
+			return
+		}
+		t := lane.tasks[0]
+		lane.tasks[0] = keyedTask{}
+		lane.tasks = lane.tasks[1:]
+		pool.laneMu.Unlock()
+
+		started := pool.metrics.start(t.enqueued)
+		err := safeCall(t.fn)
+		pool.metrics.finish(started, err)
+		pool.record(err)
+	}
+}
+
+func TestConcurrency27(t *testing.T) {
+	t.Run("相同 key 按提交顺序串行执行", func(t *testing.T) {
+		pool := NewWorkPool(4, 100)
+
+		keys := []string{"user-1", "user-2", "user-3", "user-4"}
+		var mu sync.Mutex
+		results := make(map[string][]int)
+		running := make(map[string]*int32)
+		for _, key := range keys {
+			running[key] = new(int32)
+		}
+
+		for i := 0; i < 50; i++ {
+			for _, key := range keys {
+				ok := pool.SubmitKeyed(key, func() error {
+					if atomic.AddInt32(running[key], 1) != 1 {
+						t.Errorf("key %s 的任务被并发执行", key)
+					}
+					time.Sleep(time.Duration(i%3) * time.Millisecond)
+					mu.Lock()
+					results[key] = append(results[key], i)
+					mu.Unlock()
+					atomic.AddInt32(running[key], -1)
+					return nil
+				}, time.Second)
+				if !ok {
+					t.Fatalf("key %s 的任务 %d 提交失败", key, i)
+				}
+			}
+		}
+		pool.Wait()
+
+		for _, key := range keys {
+			if len(results[key]) != 50 {
+				t.Fatalf("key %s 期望执行 50 个任务，实际 %d 个", key, len(results[key]))
+			}
+			for i, seq := range results[key] {
+				if seq != i {
+					t.Fatalf("key %s 的执行顺序错误: %v", key, results[key])
+				}
+			}
+		}
+		t.Logf("%d 个 key 的任务都按提交顺序执行", len(keys))
+	})
+
+	t.Run("不同 key 并行执行", func(t *testing.T) {
+		pool := NewWorkPool(4, 10)
+
+		var active, maxActive int32
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			pool.SubmitKeyed(fmt.Sprintf("order-%d", i), func() error {
+				current := atomic.AddInt32(&active, 1)
+				for {
+					max := atomic.LoadInt32(&maxActive)
+					if current <= max || atomic.CompareAndSwapInt32(&maxActive, max, current) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				return nil
+			}, time.Second)
+		}
+		pool.Wait()
+
+		if maxActive < 2 {
+			t.Errorf("期望不同 key 的任务并行执行，实际最大并发数 %d", maxActive)
+		}
+		t.Logf("不同 key 最大并发数 %d，耗时 %v", maxActive, time.Since(start))
+	})
+
+	t.Run("按顺序打印 ABCD", func(t *testing.T) {
+		pool := NewWorkPool(4, 10)
+
+		// 所有字母使用同一个 key，保证按 ABCDABCD... 的顺序打印
+		var mu sync.Mutex
+		var printed []byte
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 4; j++ {
+				char := byte('A' + j)
+				pool.SubmitKeyed("printer", func() error {
+					mu.Lock()
+					printed = append(printed, char)
+					mu.Unlock()
+					return nil
+				}, time.Second)
+			}
+		}
+		pool.Wait()
+
+		for i, char := range printed {
+			if char != byte('A'+i%4) {
+				t.Fatalf("打印顺序错误: %s", printed)
+			}
+		}
+		if len(printed) != 40 {
+			t.Errorf("期望打印 40 个字母，实际 %d 个", len(printed))
+		}
+	})
+
+	t.Run("关闭和超时时拒绝提交", func(t *testing.T) {
+		pool := NewWorkPool(1, 0)
+
+		blockChan := make(chan struct{})
+		pool.Submit(func() error {
+			<-blockChan
+			return nil
+		}, time.Second)
+
+		// 唯一的 worker 被占用，drain 任务无法入队
+		if pool.SubmitKeyed("user-1", func() error { return nil }, 20*time.Millisecond) {
+			t.Error("期望提交超时，但实际成功了")
+		}
+		close(blockChan)
+
+		var counter int32
+		if !pool.SubmitKeyed("user-1", func() error {
+			atomic.AddInt32(&counter, 1)
+			return nil
+		}, time.Second) {
+			t.Error("超时之后同一个 key 的任务应该可以再次提交")
+		}
+		pool.Wait()
+		if pool.SubmitKeyed("user-1", func() error { return nil }, time.Second) {
+			t.Error("期望关闭后拒绝新任务，但实际接受了")
+		}
+		if counter != 1 {
+			t.Errorf("期望执行 1 个任务，实际执行了 %d 个", counter)
+		}
+
+		stats := pool.Stats()
+		if stats.RejectedTimeout != 1 || stats.RejectedClosed != 1 || stats.Completed != 2 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+	})
+}
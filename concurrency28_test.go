@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 为WorkPool实现延时任务和周期任务：ScheduleAfter、ScheduleAt、ScheduleEvery
+// 到期的任务会被提交到WorkPool现有的worker中执行，返回的ScheduledTask可以用来取消
+//
+// 和concurrency22中的After为每个定时器启动一个goroutine不同，这里所有任务放在一个按到期时间排序的最小堆中，
+// 只用一个goroutine和一个timer驱动，Close/Wait之后调度goroutine退出，未到期的任务不再执行
+
+// ScheduledTask 表示一个已注册的延时/周期任务
+type ScheduledTask struct {
+	at       time.Time
+	interval time.Duration // 大于0表示周期任务
+	task     func() error
+	index    int // 在堆中的下标，-1表示已经不在堆中（已触发的一次性任务或已取消）
+	sched    *scheduler
+}
+
+// Cancel 取消任务，返回false表示任务已经触发（一次性任务）或者已经被取消
+func (st *ScheduledTask) Cancel() bool {
+	s := st.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.index < 0 {
+		return false
+	}
+	heap.Remove(&s.items, st.index)
+	return true
+}
+
+type scheduleHeap []*ScheduledTask
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *scheduleHeap) Push(x any) {
+	item := x.(*ScheduledTask)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	items   scheduleHeap
+	wake    chan struct{} // 堆顶变化时通知调度goroutine重新计算等待时间
+	started bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+// ScheduleAfter 在delay之后执行一次task
+func (pool *WorkPool) ScheduleAfter(delay time.Duration, task func() error) (*ScheduledTask, bool) {
+	return pool.schedule(time.Now().Add(delay), 0, task)
+}
+
+// ScheduleAt 在指定时间执行一次task，时间已过时会尽快执行
+func (pool *WorkPool) ScheduleAt(at time.Time, task func() error) (*ScheduledTask, bool) {
+	return pool.schedule(at, 0, task)
+}
+
+// ScheduleEvery 每隔interval执行一次task，第一次在interval之后执行
+// 和time.Ticker一样，调度落后时会跳过错过的周期，而不是连续补执行
+func (pool *WorkPool) ScheduleEvery(interval time.Duration, task func() error) (*ScheduledTask, bool) {
+	if interval <= 0 {
+		return nil, false
+	}
+	return pool.schedule(time.Now().Add(interval), interval, task)
+}
+
+func (pool *WorkPool) schedule(at time.Time, interval time.Duration, task func() error) (*ScheduledTask, bool) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed.Load() {
+		return nil, false
+	}
+
+	s := pool.sched
+	st := &ScheduledTask{at: at, interval: interval, task: task, sched: s}
+	s.mu.Lock()
+	heap.Push(&s.items, st)
+	if !s.started {
+		s.started = true
+		pool.wg.Add(1)
+		go pool.runScheduler()
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return st, true
+}
+
+// runScheduler 每次取出所有到期的任务提交到worker，然后等待到下一个任务到期
+func (pool *WorkPool) runScheduler() {
+	defer pool.wg.Done()
+
+	s := pool.sched
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		var due []*ScheduledTask
+		for len(s.items) > 0 && !s.items[0].at.After(now) {
+			st := s.items[0]
+			if st.interval > 0 {
+				st.at = st.at.Add(st.interval)
+				if !st.at.After(now) {
+					st.at = now.Add(st.interval)
+				}
+				heap.Fix(&s.items, 0)
+			} else {
+				heap.Pop(&s.items)
+			}
+			due = append(due, st)
+		}
+		wait := time.Duration(-1)
+		if len(s.items) > 0 {
+			wait = s.items[0].at.Sub(now)
+		}
+		s.mu.Unlock()
+
+		// 队列满时这里会阻塞，相当于对调度做了背压；pool关闭时send会立即返回
+		for _, st := range due {
+			pool.enqueue(context.Background(), st.task, PriorityNormal)
+		}
+
+		if wait >= 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-pool.shutdown:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func TestConcurrency28(t *testing.T) {
+	t.Run("ScheduleAfter 和 ScheduleAt", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+		defer pool.Wait()
+
+		start := time.Now()
+		done := make(chan time.Duration, 2)
+		pool.ScheduleAfter(50*time.Millisecond, func() error {
+			done <- time.Since(start)
+			return nil
+		})
+		pool.ScheduleAt(start.Add(20*time.Millisecond), func() error {
+			done <- time.Since(start)
+			return nil
+		})
+
+		first, second := <-done, <-done
+		if first < 20*time.Millisecond || second < 50*time.Millisecond {
+			t.Errorf("任务过早执行：%v, %v", first, second)
+		}
+		if second > 150*time.Millisecond {
+			t.Errorf("任务执行延迟过大：%v", second)
+		}
+		t.Logf("ScheduleAt 在 %v 执行，ScheduleAfter 在 %v 执行", first, second)
+	})
+
+	t.Run("ScheduleEvery 周期执行并可以取消", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+		defer pool.Wait()
+
+		var counter int32
+		st, ok := pool.ScheduleEvery(10*time.Millisecond, func() error {
+			atomic.AddInt32(&counter, 1)
+			return nil
+		})
+		if !ok {
+			t.Fatal("注册周期任务失败")
+		}
+		time.Sleep(105 * time.Millisecond)
+		if !st.Cancel() {
+			t.Error("期望第一次 Cancel 返回 true")
+		}
+		if st.Cancel() {
+			t.Error("期望重复 Cancel 返回 false")
+		}
+		time.Sleep(20 * time.Millisecond)
+		n := atomic.LoadInt32(&counter)
+		time.Sleep(50 * time.Millisecond)
+
+		if n < 5 {
+			t.Errorf("期望周期任务执行约 10 次，实际 %d 次", n)
+		}
+		if after := atomic.LoadInt32(&counter); after != n {
+			t.Errorf("取消后周期任务仍在执行：%d -> %d", n, after)
+		}
+		if _, ok := pool.ScheduleEvery(0, func() error { return nil }); ok {
+			t.Error("期望拒绝 interval <= 0 的周期任务")
+		}
+		t.Logf("周期任务取消前执行了 %d 次", n)
+	})
+
+	t.Run("取消未触发的任务", func(t *testing.T) {
+		pool := NewWorkPool(1, 10)
+
+		var counter int32
+		st, _ := pool.ScheduleAfter(30*time.Millisecond, func() error {
+			atomic.AddInt32(&counter, 1)
+			return nil
+		})
+		fired, _ := pool.ScheduleAfter(0, func() error {
+			atomic.AddInt32(&counter, 10)
+			return nil
+		})
+		if !st.Cancel() {
+			t.Error("期望取消成功")
+		}
+		time.Sleep(60 * time.Millisecond)
+		if fired.Cancel() {
+			t.Error("期望已触发的一次性任务无法取消")
+		}
+		pool.Wait()
+
+		if counter != 10 {
+			t.Errorf("期望只执行未取消的任务，实际 counter=%d", counter)
+		}
+	})
+
+	t.Run("Wait 停止调度", func(t *testing.T) {
+		pool := NewWorkPool(2, 10)
+
+		var counter int32
+		pool.ScheduleAfter(50*time.Millisecond, func() error {
+			atomic.AddInt32(&counter, 1)
+			return nil
+		})
+		pool.ScheduleEvery(10*time.Millisecond, func() error {
+			atomic.AddInt32(&counter, 100)
+			return nil
+		})
+		time.Sleep(5 * time.Millisecond)
+
+		start := time.Now()
+		pool.Wait()
+		if elapsed := time.Since(start); elapsed > 30*time.Millisecond {
+			t.Errorf("Wait 等待了未到期的任务，耗时 %v", elapsed)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if counter != 0 {
+			t.Errorf("期望关闭后不再执行调度任务，实际 counter=%d", counter)
+		}
+		if _, ok := pool.ScheduleAfter(0, func() error { return nil }); ok {
+			t.Error("期望关闭后拒绝新的调度任务")
+		}
+	})
+
+	t.Run("只使用一个调度 goroutine", func(t *testing.T) {
+		pool := NewWorkPool(2, 100)
+		defer pool.Wait()
+
+		before := runtime.NumGoroutine()
+		tasks := make([]*ScheduledTask, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			st, _ := pool.ScheduleAfter(time.Hour+time.Duration(i)*time.Millisecond, func() error { return nil })
+			tasks = append(tasks, st)
+		}
+		if diff := runtime.NumGoroutine() - before; diff > 1 {
+			t.Errorf("期望最多新增 1 个 goroutine，实际新增 %d 个", diff)
+		}
+		for _, st := range tasks {
+			st.Cancel()
+		}
+	})
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 设计一个通用的限流器接口，支持多种限流算法：令牌桶、固定窗口、滑动窗口日志、滑动窗口计数、GCRA
+// 所有算法共享Allow/Wait/Reserve语义，可以按接口选择不同的算法，并在测试中比较它们的突发行为
+//
+// 每种算法只需要实现reserve：计算在now时刻申请n个许可需要等待多久，等待时间不超过maxWait时才真正占用许可
+//
+// 构造函数的参数必须满足limit>0、per(window)>0、burst>=1，否则返回拒绝所有请求的限流器：
+// 配置漏填时宁可全部拒绝，也不能悄悄地不限流
+
+var ErrLimitExceeded = errors.New("rate limit exceeded")
+
+type Limiter interface {
+	// Allow 不等待，当前有可用许可时返回true
+	Allow() bool
+	// Wait 阻塞直到获得许可，ctx取消或者在ctx的deadline之前无法获得许可时返回错误
+	Wait(ctx context.Context) error
+	// Reserve 预占一个许可，返回的Reservation说明需要等待多久才能执行
+	Reserve() *Reservation
+}
+
+// Reservation 表示一次预占的结果，OK为false时表示请求的许可数超过了限流器的容量，永远无法满足
+type Reservation struct {
+	ok        bool
+	timeToAct time.Time
+	now       func() time.Time
+}
+
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay 返回距离可以执行还需要等待的时间
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return time.Duration(math.MaxInt64)
+	}
+	if d := r.timeToAct.Sub(r.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// limitAlgorithm 是各个限流算法需要实现的核心逻辑，调用时已经持有锁
+type limitAlgorithm interface {
+	reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool)
+}
+
+// AlgoLimiter 把limitAlgorithm包装成Limiter，除了Limiter的方法外还支持一次申请n个许可
+type AlgoLimiter struct {
+	mu   sync.Mutex
+	alg  limitAlgorithm
+	now  func() time.Time
+	wait func(ctx context.Context, d time.Duration) error
+}
+
+func newAlgoLimiter(alg limitAlgorithm) *AlgoLimiter {
+	return &AlgoLimiter{alg: alg, now: time.Now, wait: sleepContext}
+}
+
+// denyAll 用于参数不合法的限流器，拒绝所有请求
+type denyAll struct{}
+
+func (denyAll) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	return 0, false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *AlgoLimiter) reserve(n int, maxWait time.Duration) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	delay, ok := l.alg.reserve(now, n, maxWait)
+	return now.Add(delay), ok
+}
+
+func (l *AlgoLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *AlgoLimiter) AllowN(n int) bool {
+	_, ok := l.reserve(n, 0)
+	return ok
+}
+
+func (l *AlgoLimiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// WaitN 等待n个许可，ctx在等待过程中取消时已经预占的许可不会归还
+func (l *AlgoLimiter) WaitN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	maxWait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(l.now())
+	}
+	at, ok := l.reserve(n, maxWait)
+	if !ok {
+		return ErrLimitExceeded
+	}
+	return l.wait(ctx, at.Sub(l.now()))
+}
+
+func (l *AlgoLimiter) Reserve() *Reservation {
+	return l.ReserveN(1)
+}
+
+func (l *AlgoLimiter) ReserveN(n int) *Reservation {
+	at, ok := l.reserve(n, time.Duration(math.MaxInt64))
+	return &Reservation{ok: ok, timeToAct: at, now: l.now}
+}
+
+// 令牌桶：令牌按固定速率生成，最多积累burst个，允许一定的突发流量
+// 令牌数可以为负数，表示已经被预占的未来令牌
+type tokenBucket struct {
+	rate   float64 // 每秒生成的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucketLimiter(limit int, per time.Duration, burst int) *AlgoLimiter {
+	if limit <= 0 || per <= 0 || burst < 1 {
+		return newAlgoLimiter(denyAll{})
+	}
+	return newAlgoLimiter(&tokenBucket{
+		rate:   float64(limit) / per.Seconds(),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	})
+}
+
+func (tb *tokenBucket) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	if float64(n) > tb.burst {
+		return 0, false
+	}
+	tokens := tb.tokens
+	if !tb.last.IsZero() && now.After(tb.last) {
+		tokens = math.Min(tb.burst, tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tokens -= float64(n)
+	var delay time.Duration
+	if tokens < 0 {
+		delay = time.Duration(-tokens / tb.rate * float64(time.Second))
+	}
+	if delay > maxWait {
+		return delay, false
+	}
+	tb.tokens = tokens
+	if now.After(tb.last) {
+		tb.last = now
+	}
+	return delay, true
+}
+
+// 固定窗口：每个窗口内最多limit个请求，窗口切换时计数清零，窗口边界处可能出现两倍的突发
+// count可以超过limit，超出的部分表示预占了后续窗口的名额
+type fixedWindow struct {
+	limit  int
+	window time.Duration
+	start  time.Time
+	count  int
+}
+
+func NewFixedWindowLimiter(limit int, window time.Duration) *AlgoLimiter {
+	if limit <= 0 || window <= 0 {
+		return newAlgoLimiter(denyAll{})
+	}
+	return newAlgoLimiter(&fixedWindow{limit: limit, window: window})
+}
+
+func (fw *fixedWindow) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	if n > fw.limit {
+		return 0, false
+	}
+	if fw.start.IsZero() {
+		fw.start = now.Truncate(fw.window)
+	}
+	if passed := int(now.Sub(fw.start) / fw.window); passed > 0 {
+		fw.count = max(0, fw.count-passed*fw.limit)
+		fw.start = fw.start.Add(time.Duration(passed) * fw.window)
+	}
+
+	// 第i个名额属于第i/limit个窗口，n个名额需要放在同一个窗口中
+	idx := fw.count / fw.limit
+	if (fw.count+n-1)/fw.limit != idx {
+		idx++
+	}
+	var delay time.Duration
+	if idx > 0 {
+		delay = fw.start.Add(time.Duration(idx) * fw.window).Sub(now)
+	}
+	if delay > maxWait {
+		return delay, false
+	}
+	fw.count = max(fw.count, idx*fw.limit) + n
+	return delay, true
+}
+
+// 滑动窗口日志：记录每个请求的时间，任意长度为window的时间段内最多limit个请求，精确但需要O(limit)的内存
+type slidingWindowLog struct {
+	limit  int
+	window time.Duration
+	log    []time.Time // 按时间排序，可能包含预占的未来时间
+}
+
+func NewSlidingWindowLogLimiter(limit int, window time.Duration) *AlgoLimiter {
+	if limit <= 0 || window <= 0 {
+		return newAlgoLimiter(denyAll{})
+	}
+	return newAlgoLimiter(&slidingWindowLog{limit: limit, window: window})
+}
+
+func (sl *slidingWindowLog) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	if n > sl.limit {
+		return 0, false
+	}
+	expired := 0
+	for expired < len(sl.log) && !sl.log[expired].After(now.Add(-sl.window)) {
+		expired++
+	}
+	sl.log = sl.log[expired:]
+
+	at := now
+	if m := len(sl.log); m+n > sl.limit {
+		// 需要等到最早的m+n-limit个请求滑出窗口
+		at = sl.log[m+n-sl.limit-1].Add(sl.window)
+	}
+	if last := len(sl.log) - 1; last >= 0 && sl.log[last].After(at) {
+		at = sl.log[last]
+	}
+	delay := at.Sub(now)
+	if delay > maxWait {
+		return delay, false
+	}
+	for i := 0; i < n; i++ {
+		sl.log = append(sl.log, at)
+	}
+	return delay, true
+}
+
+// 滑动窗口计数：只记录每个固定窗口的计数，用上一个窗口的计数按时间比例估算滑动窗口内的请求数
+// 内存为O(1)，但只是近似值
+type slidingWindowCounter struct {
+	limit  int
+	window time.Duration
+	counts map[int64]int // 窗口编号 -> 计数，包含预占的未来窗口
+}
+
+func NewSlidingWindowCounterLimiter(limit int, window time.Duration) *AlgoLimiter {
+	if limit <= 0 || window <= 0 {
+		return newAlgoLimiter(denyAll{})
+	}
+	return newAlgoLimiter(&slidingWindowCounter{limit: limit, window: window, counts: make(map[int64]int)})
+}
+
+func (sc *slidingWindowCounter) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	if n > sc.limit {
+		return 0, false
+	}
+	cur := now.UnixNano() / int64(sc.window)
+	for k := range sc.counts {
+		if k < cur-1 {
+			delete(sc.counts, k)
+		}
+	}
+
+	// 从当前窗口开始找第一个能容纳n个请求的时间点：prev*(1-f) + curr + n <= limit
+	for k := cur; ; k++ {
+		prev, curr := sc.counts[k-1], sc.counts[k]
+		if curr+n > sc.limit {
+			continue
+		}
+		f := 0.0
+		if prev > 0 {
+			f = math.Max(0, 1-float64(sc.limit-curr-n)/float64(prev))
+		}
+		at := time.Unix(0, k*int64(sc.window)).Add(time.Duration(math.Ceil(f * float64(sc.window))))
+		if at.Before(now) {
+			at = now
+		}
+		delay := at.Sub(now)
+		if delay > maxWait {
+			return delay, false
+		}
+		sc.counts[k] += n
+		return delay, true
+	}
+}
+
+// GCRA（通用信元速率算法）：只记录下一个请求的理论到达时间tat，效果等同于令牌桶，但只需要一个时间戳
+type gcra struct {
+	interval  time.Duration // 两个请求之间的理论间隔
+	tolerance time.Duration // 允许提前到达的时间，决定突发大小
+	burst     int
+	tat       time.Time
+}
+
+func NewGCRALimiter(limit int, per time.Duration, burst int) *AlgoLimiter {
+	if limit <= 0 || per <= 0 || burst < 1 {
+		return newAlgoLimiter(denyAll{})
+	}
+	interval := per / time.Duration(limit)
+	return newAlgoLimiter(&gcra{
+		interval:  interval,
+		tolerance: interval * time.Duration(burst),
+		burst:     burst,
+	})
+}
+
+func (g *gcra) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	if n > g.burst {
+		return 0, false
+	}
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(time.Duration(n) * g.interval)
+	delay := newTat.Add(-g.tolerance).Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxWait {
+		return delay, false
+	}
+	g.tat = newTat
+	return delay, true
+}
+
+// fakeClock 用于在测试中精确控制时间
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// withFakeClock 让limiter使用假时钟，Wait时直接推进时钟而不是真正睡眠
+func withFakeClock(l *AlgoLimiter, clock *fakeClock) *AlgoLimiter {
+	l.now = clock.Now
+	l.wait = func(ctx context.Context, d time.Duration) error {
+		if d > 0 {
+			clock.Advance(d)
+		}
+		return ctx.Err()
+	}
+	return l
+}
+
+func TestConcurrency29(t *testing.T) {
+	// 所有算法都配置为每秒 5 个请求，突发为 5
+	newLimiters := func(clock *fakeClock) map[string]*AlgoLimiter {
+		return map[string]*AlgoLimiter{
+			"token_bucket":           withFakeClock(NewTokenBucketLimiter(5, time.Second, 5), clock),
+			"fixed_window":           withFakeClock(NewFixedWindowLimiter(5, time.Second), clock),
+			"sliding_window_log":     withFakeClock(NewSlidingWindowLogLimiter(5, time.Second), clock),
+			"sliding_window_counter": withFakeClock(NewSlidingWindowCounterLimiter(5, time.Second), clock),
+			"gcra":                   withFakeClock(NewGCRALimiter(5, time.Second, 5), clock),
+		}
+	}
+
+	t.Run("实现 Limiter 接口", func(t *testing.T) {
+		for name, l := range newLimiters(newFakeClock()) {
+			var _ Limiter = l
+			if !l.Allow() {
+				t.Errorf("%s: 第一个请求应该被允许", name)
+			}
+		}
+	})
+
+	t.Run("初始突发", func(t *testing.T) {
+		for name, l := range newLimiters(newFakeClock()) {
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if l.Allow() {
+					allowed++
+				}
+			}
+			if allowed != 5 {
+				t.Errorf("%s: 期望突发允许 5 个请求，实际 %d 个", name, allowed)
+			}
+		}
+	})
+
+	t.Run("窗口边界突发", func(t *testing.T) {
+		// 在窗口结束前和下一个窗口开始时各发送 5 个请求
+		results := make(map[string]int)
+		clock := newFakeClock()
+		limiters := newLimiters(clock)
+		clock.Advance(900 * time.Millisecond)
+		for name, l := range limiters {
+			for i := 0; i < 5; i++ {
+				if l.Allow() {
+					results[name]++
+				}
+			}
+		}
+		clock.Advance(200 * time.Millisecond)
+		for name, l := range limiters {
+			for i := 0; i < 5; i++ {
+				if l.Allow() {
+					results[name]++
+				}
+			}
+		}
+		for name, n := range results {
+			t.Logf("%s: 200ms 内允许了 %d 个请求", name, n)
+		}
+
+		// 固定窗口在边界处允许两倍突发，滑动窗口日志严格限制任意 1s 内最多 5 个
+		if results["fixed_window"] != 10 {
+			t.Errorf("fixed_window: 期望边界处允许 10 个请求，实际 %d 个", results["fixed_window"])
+		}
+		if results["sliding_window_log"] != 5 {
+			t.Errorf("sliding_window_log: 期望只允许 5 个请求，实际 %d 个", results["sliding_window_log"])
+		}
+		// 令牌桶和 GCRA 在 200ms 内恢复 1 个令牌
+		if results["token_bucket"] != 6 || results["gcra"] != 6 {
+			t.Errorf("期望令牌桶和 GCRA 允许 6 个请求，实际 %d, %d", results["token_bucket"], results["gcra"])
+		}
+		// 滑动窗口计数按比例估算：5*(1-0.1) = 4.5，所以新窗口只能再允许 0 个
+		if results["sliding_window_counter"] != 5 {
+			t.Errorf("sliding_window_counter: 期望允许 5 个请求，实际 %d 个", results["sliding_window_counter"])
+		}
+	})
+
+	t.Run("Reserve 返回等待时间", func(t *testing.T) {
+		expected := map[string]time.Duration{
+			"token_bucket":           200 * time.Millisecond,
+			"fixed_window":           time.Second,
+			"sliding_window_log":     time.Second,
+			"sliding_window_counter": 1200 * time.Millisecond, // 新窗口中上一个窗口的权重降到 4 以下才允许
+			"gcra":                   200 * time.Millisecond,
+		}
+		for name, l := range newLimiters(newFakeClock()) {
+			for i := 0; i < 5; i++ {
+				l.Reserve()
+			}
+			r := l.Reserve()
+			if !r.OK() || r.Delay() != expected[name] {
+				t.Errorf("%s: 期望等待 %v，实际 ok=%v delay=%v", name, expected[name], r.OK(), r.Delay())
+			}
+			if l.Allow() {
+				t.Errorf("%s: 预占之后不应该再允许请求", name)
+			}
+			if r := l.ReserveN(6); r.OK() {
+				t.Errorf("%s: 超过容量的请求应该永远无法满足", name)
+			}
+		}
+	})
+
+	t.Run("Wait 平滑限速", func(t *testing.T) {
+		for name, l := range newLimiters(newFakeClock()) {
+			clock := newFakeClock()
+			withFakeClock(l, clock)
+			start := clock.Now()
+			for i := 0; i < 15; i++ {
+				if err := l.Wait(context.Background()); err != nil {
+					t.Fatalf("%s: Wait 失败: %v", name, err)
+				}
+			}
+			// 5 个突发之后，剩下 10 个请求至少需要 2s
+			if elapsed := clock.Now().Sub(start); elapsed < 2*time.Second {
+				t.Errorf("%s: 15 个请求只用了 %v", name, elapsed)
+			} else {
+				t.Logf("%s: 15 个请求耗时 %v", name, elapsed)
+			}
+		}
+	})
+
+	t.Run("Wait 受 ctx 限制", func(t *testing.T) {
+		l := NewTokenBucketLimiter(1, time.Second, 1)
+		l.Allow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := l.Wait(ctx); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("期望 deadline 之前无法获得许可时返回 %v，实际 %v", ErrLimitExceeded, err)
+		}
+
+		cancel()
+		if err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("期望返回 %v，实际 %v", context.Canceled, err)
+		}
+	})
+	t.Run("参数不合法时拒绝所有请求", func(t *testing.T) {
+		limiters := map[string]*AlgoLimiter{
+			"token_bucket limit=0":            NewTokenBucketLimiter(0, time.Second, 1),
+			"token_bucket per=0":              NewTokenBucketLimiter(5, 0, 5),
+			"token_bucket burst=0":            NewTokenBucketLimiter(5, time.Second, 0),
+			"fixed_window limit=0":            NewFixedWindowLimiter(0, time.Second),
+			"fixed_window window=0":           NewFixedWindowLimiter(5, 0),
+			"sliding_window_log limit=-1":     NewSlidingWindowLogLimiter(-1, time.Second),
+			"sliding_window_counter window=0": NewSlidingWindowCounterLimiter(5, 0),
+			"gcra limit=0":                    NewGCRALimiter(0, time.Second, 5),
+			"gcra burst=0":                    NewGCRALimiter(5, time.Second, 0),
+		}
+		for name, l := range limiters {
+			for i := 0; i < 10; i++ {
+				if l.Allow() {
+					t.Errorf("%s: 期望拒绝所有请求", name)
+					break
+				}
+			}
+			if r := l.Reserve(); r.OK() {
+				t.Errorf("%s: 期望 Reserve 失败，实际等待 %v", name, r.Delay())
+			}
+			if err := l.Wait(context.Background()); !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("%s: 期望 Wait 返回 %v，实际 %v", name, ErrLimitExceeded, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 实现一个按key限流的限流器管理器，例如按API key或者客户端IP限流
+// 每个key第一次访问时才创建限流器，长时间没有访问的key会被淘汰，key的数量超过上限时淘汰最久没有访问的key
+// 支持为某些key（例如付费用户）单独设置速率和突发大小
+//
+// 淘汰逻辑和concurrency11中的LRUCache一样使用container/list维护访问顺序，但LRUCache的过期时间从写入时开始计算，
+// 而这里需要按空闲时间（距离最后一次访问）淘汰，所以单独维护；淘汰在每次访问时顺便进行，不需要后台goroutine
+
+// LimitConfig 表示每Per时间允许Limit个请求，最多突发Burst个
+// 字段没有设置（Limit<=0、Per<=0或者Burst<1）时对应的key拒绝所有请求，而不是不限流
+type LimitConfig struct {
+	Limit int
+	Per   time.Duration
+	Burst int
+}
+
+type keyedLimiterEntry struct {
+	key      string
+	limiter  *AlgoLimiter
+	lastSeen time.Time
+}
+
+type KeyedRateLimiter struct {
+	mu        sync.Mutex
+	def       LimitConfig
+	overrides map[string]LimitConfig
+	maxKeys   int
+	idleTTL   time.Duration
+	entries   map[string]*list.Element
+	lru       *list.List // 前面是最近访问的key
+	now       func() time.Time
+}
+
+// NewKeyedRateLimiter 创建按key限流的管理器，maxKeys<=0表示不限制key的数量，idleTTL<=0表示不按空闲时间淘汰
+// 被淘汰的key再次访问时会创建新的限流器，所以idleTTL应该不小于令牌桶从空到满需要的时间，否则淘汰会提前重置限流状态
+func NewKeyedRateLimiter(def LimitConfig, maxKeys int, idleTTL time.Duration) *KeyedRateLimiter {
+	return &KeyedRateLimiter{
+		def:       def,
+		overrides: make(map[string]LimitConfig),
+		maxKeys:   maxKeys,
+		idleTTL:   idleTTL,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		now:       time.Now,
+	}
+}
+
+// Allow 判断key当前是否允许请求
+func (kl *KeyedRateLimiter) Allow(key string) bool {
+	return kl.Limiter(key).Allow()
+}
+
+// Limiter 返回key对应的限流器，不存在时创建，可以用来调用Wait/Reserve
+func (kl *KeyedRateLimiter) Limiter(key string) *AlgoLimiter {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	now := kl.now()
+	kl.evictIdleLocked(now)
+	if elem, ok := kl.entries[key]; ok {
+		entry := elem.Value.(*keyedLimiterEntry)
+		entry.lastSeen = now
+		kl.lru.MoveToFront(elem)
+		return entry.limiter
+	}
+
+	cfg, ok := kl.overrides[key]
+	if !ok {
+		cfg = kl.def
+	}
+	limiter := NewTokenBucketLimiter(cfg.Limit, cfg.Per, cfg.Burst)
+	limiter.now = kl.now
+	kl.entries[key] = kl.lru.PushFront(&keyedLimiterEntry{key: key, limiter: limiter, lastSeen: now})
+	if kl.maxKeys > 0 && kl.lru.Len() > kl.maxKeys {
+		kl.removeLocked(kl.lru.Back())
+	}
+	return limiter
+}
+
+// SetOverride 为key单独设置限流配置，key已有的限流器会被丢弃，下次访问时按新配置创建
+func (kl *KeyedRateLimiter) SetOverride(key string, cfg LimitConfig) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.overrides[key] = cfg
+	if elem, ok := kl.entries[key]; ok {
+		kl.removeLocked(elem)
+	}
+}
+
+// RemoveOverride 删除key的单独配置，恢复默认配置
+func (kl *KeyedRateLimiter) RemoveOverride(key string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	delete(kl.overrides, key)
+	if elem, ok := kl.entries[key]; ok {
+		kl.removeLocked(elem)
+	}
+}
+
+// Len 返回当前持有限流器的key数量
+func (kl *KeyedRateLimiter) Len() int {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.evictIdleLocked(kl.now())
+	return kl.lru.Len()
+}
+
+// evictIdleLocked 从最久没有访问的key开始淘汰空闲超过idleTTL的key
+func (kl *KeyedRateLimiter) evictIdleLocked(now time.Time) {
+	if kl.idleTTL <= 0 {
+		return
+	}
+	for back := kl.lru.Back(); back != nil; back = kl.lru.Back() {
+		if now.Sub(back.Value.(*keyedLimiterEntry).lastSeen) < kl.idleTTL {
+			return
+		}
+		kl.removeLocked(back)
+	}
+}
+
+func (kl *KeyedRateLimiter) removeLocked(elem *list.Element) {
+	kl.lru.Remove(elem)
+	delete(kl.entries, elem.Value.(*keyedLimiterEntry).key)
+}
+
+func TestConcurrency30(t *testing.T) {
+	def := LimitConfig{Limit: 2, Per: time.Second, Burst: 2}
+
+	t.Run("不同 key 互不影响", func(t *testing.T) {
+		kl := NewKeyedRateLimiter(def, 0, 0)
+		kl.now = newFakeClock().Now
+
+		for _, key := range []string{"10.0.0.1", "10.0.0.2"} {
+			allowed := 0
+			for i := 0; i < 5; i++ {
+				if kl.Allow(key) {
+					allowed++
+				}
+			}
+			if allowed != 2 {
+				t.Errorf("%s: 期望允许 2 个请求，实际 %d 个", key, allowed)
+			}
+		}
+	})
+
+	t.Run("单独配置付费用户", func(t *testing.T) {
+		kl := NewKeyedRateLimiter(def, 0, 0)
+		kl.now = newFakeClock().Now
+
+		kl.Allow("premium")
+		kl.SetOverride("premium", LimitConfig{Limit: 10, Per: time.Second, Burst: 10})
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if kl.Allow("premium") {
+				allowed++
+			}
+		}
+		if allowed != 10 {
+			t.Errorf("期望付费用户允许 10 个请求，实际 %d 个", allowed)
+		}
+
+		kl.RemoveOverride("premium")
+		allowed = 0
+		for i := 0; i < 20; i++ {
+			if kl.Allow("premium") {
+				allowed++
+			}
+		}
+		if allowed != 2 {
+			t.Errorf("期望恢复默认配置后允许 2 个请求，实际 %d 个", allowed)
+		}
+	})
+
+	t.Run("配置不完整时拒绝请求", func(t *testing.T) {
+		kl := NewKeyedRateLimiter(LimitConfig{Per: time.Second, Burst: 5}, 0, 0)
+		kl.now = newFakeClock().Now
+		kl.SetOverride("premium", LimitConfig{Limit: 10, Per: time.Second})
+
+		for _, key := range []string{"default", "premium"} {
+			for i := 0; i < 5; i++ {
+				if kl.Allow(key) {
+					t.Errorf("%s: 期望 Limit 或 Burst 为 0 时拒绝所有请求", key)
+					break
+				}
+			}
+		}
+	})
+
+	t.Run("淘汰空闲的 key", func(t *testing.T) {
+		clock := newFakeClock()
+		kl := NewKeyedRateLimiter(def, 0, time.Minute)
+		kl.now = clock.Now
+
+		kl.Allow("a")
+		clock.Advance(30 * time.Second)
+		kl.Allow("b")
+		clock.Advance(40 * time.Second)
+		if n := kl.Len(); n != 1 {
+			t.Errorf("期望淘汰空闲 70s 的 key 后剩下 1 个，实际 %d 个", n)
+		}
+		clock.Advance(time.Minute)
+		if n := kl.Len(); n != 0 {
+			t.Errorf("期望所有 key 都被淘汰，实际剩下 %d 个", n)
+		}
+	})
+
+	t.Run("key 数量上限", func(t *testing.T) {
+		kl := NewKeyedRateLimiter(def, 100, 0)
+		kl.now = newFakeClock().Now
+
+		hot := kl.Limiter("hot")
+		for i := 0; i < 1000; i++ {
+			kl.Allow(fmt.Sprintf("client-%d", i))
+			kl.Allow("hot")
+		}
+		if n := kl.Len(); n != 100 {
+			t.Errorf("期望最多保留 100 个 key，实际 %d 个", n)
+		}
+		if kl.Limiter("hot") != hot {
+			t.Error("经常访问的 key 不应该被淘汰")
+		}
+	})
+
+	t.Run("并发访问", func(t *testing.T) {
+		kl := NewKeyedRateLimiter(LimitConfig{Limit: 100, Per: time.Second, Burst: 100}, 50, time.Second)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		allowed := make(map[string]int)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				key := fmt.Sprintf("client-%d", id%5)
+				for j := 0; j < 50; j++ {
+					if kl.Allow(key) {
+						mu.Lock()
+						allowed[key]++
+						mu.Unlock()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// 每个 key 有 4 个 goroutine 共 200 次请求，突发 100 个，期间补充的令牌很少
+		for key, n := range allowed {
+			if n < 100 || n > 110 {
+				t.Errorf("%s: 期望允许约 100 个请求，实际 %d 个", key, n)
+			}
+		}
+	})
+}
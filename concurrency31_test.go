@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 为concurrency24中的Server实现一个限流中间件，防止服务过载
+// 按客户端IP或者某个请求头（例如API key）限流，超过限制时返回429，并设置Retry-After和X-RateLimit-*响应头
+// 每个路由可以使用不同的配置：
+// mux.Handle("/api/", RateLimit(RateLimitConfig{Limit: 100, Per: time.Minute, Burst: 20}, apiHandler))
+// mux.Handle("/login", RateLimit(RateLimitConfig{Limit: 5, Per: time.Minute, Burst: 5}, loginHandler))
+//
+// 每个key的限流器由concurrency30中的KeyedRateLimiter管理
+
+// RateLimitConfig 中Limit/Per/Burst的含义和LimitConfig一样，MaxKeys/IdleTTL的含义和NewKeyedRateLimiter一样
+// KeyFunc为nil时按客户端IP限流；Limit/Per/Burst没有设置时所有请求都返回429，配置错误可以立即被发现
+type RateLimitConfig struct {
+	Limit   int
+	Per     time.Duration
+	Burst   int
+	MaxKeys int
+	IdleTTL time.Duration
+	KeyFunc func(r *http.Request) string
+}
+
+type RateLimitHandler struct {
+	next    http.Handler
+	limit   int
+	keyFunc func(r *http.Request) string
+	limiter *KeyedRateLimiter
+}
+
+// RateLimit 返回对next限流的handler
+func RateLimit(cfg RateLimitConfig, next http.Handler) *RateLimitHandler {
+	keyFunc := cfg.KeyFunc
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	return &RateLimitHandler{
+		next:    next,
+		limit:   cfg.Limit,
+		keyFunc: keyFunc,
+		limiter: NewKeyedRateLimiter(LimitConfig{Limit: cfg.Limit, Per: cfg.Per, Burst: cfg.Burst}, cfg.MaxKeys, cfg.IdleTTL),
+	}
+}
+
+// KeyByIP 使用客户端IP作为限流的key，不解析X-Forwarded-For，因为客户端可以随意伪造
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader 使用请求头作为限流的key，请求头为空时退回到按IP限流
+func KeyByHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(name); v != "" {
+			return name + ":" + v
+		}
+		return KeyByIP(r)
+	}
+}
+
+func (h *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limiter := h.limiter.Limiter(h.keyFunc(r))
+	at, ok := limiter.reserve(1, 0)
+
+	header := w.Header()
+	header.Set("X-RateLimit-Limit", strconv.Itoa(h.limit))
+	if remaining, reset, ok := limiter.status(); ok {
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+	}
+	if !ok {
+		// 请求没有被放行，at是下一个许可可用的时间
+		retryAfter := ceilSeconds(at.Sub(limiter.now()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		header.Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// limitStatus 由可以报告剩余额度的算法实现，目前只有令牌桶
+type limitStatus interface {
+	// status 返回当前剩余的许可数，以及额度完全恢复还需要多久
+	status(now time.Time) (int, time.Duration)
+}
+
+// status 返回limiter的剩余额度，算法不支持时ok为false
+func (l *AlgoLimiter) status() (remaining int, reset time.Duration, ok bool) {
+	s, ok := l.alg.(limitStatus)
+	if !ok {
+		return 0, 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	remaining, reset = s.status(l.now())
+	return remaining, reset, true
+}
+
+func (tb *tokenBucket) status(now time.Time) (int, time.Duration) {
+	tokens := tb.tokens
+	if !tb.last.IsZero() && now.After(tb.last) {
+		tokens = math.Min(tb.burst, tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	reset := time.Duration((tb.burst - tokens) / tb.rate * float64(time.Second))
+	return int(math.Max(0, math.Floor(tokens))), reset
+}
+
+func TestConcurrency31(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	request := func(h http.Handler, remoteAddr string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("超过限制返回 429 和限流响应头", func(t *testing.T) {
+		h := RateLimit(RateLimitConfig{Limit: 2, Per: time.Second, Burst: 2}, ok)
+		clock := newFakeClock()
+		h.limiter.now = clock.Now
+
+		for i, remaining := range []string{"1", "0"} {
+			rec := request(h, "10.0.0.1:1234", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("第 %d 个请求期望返回 200，实际 %d", i+1, rec.Code)
+			}
+			if got := rec.Header().Get("X-RateLimit-Remaining"); got != remaining {
+				t.Errorf("第 %d 个请求期望 X-RateLimit-Remaining=%s，实际 %s", i+1, remaining, got)
+			}
+		}
+
+		rec := request(h, "10.0.0.1:1234", nil)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("期望返回 429，实际 %d", rec.Code)
+		}
+		want := map[string]string{
+			"Retry-After":           "1",
+			"X-RateLimit-Limit":     "2",
+			"X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset":     "1",
+		}
+		for k, v := range want {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("期望 %s=%s，实际 %s", k, v, got)
+			}
+		}
+
+		clock.Advance(500 * time.Millisecond)
+		if rec := request(h, "10.0.0.1:1234", nil); rec.Code != http.StatusOK {
+			t.Errorf("补充令牌后期望返回 200，实际 %d", rec.Code)
+		}
+	})
+
+	t.Run("配置不完整时返回 429", func(t *testing.T) {
+		h := RateLimit(RateLimitConfig{Per: time.Minute}, ok)
+		rec := request(h, "10.0.0.1:1234", nil)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("期望 Limit 为 0 时返回 429，实际 %d", rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("期望 Retry-After=1，实际 %s", got)
+		}
+	})
+
+	t.Run("按 IP 和请求头区分客户端", func(t *testing.T) {
+		byIP := RateLimit(RateLimitConfig{Limit: 1, Per: time.Minute, Burst: 1}, ok)
+		byIP.limiter.now = newFakeClock().Now
+		if request(byIP, "10.0.0.1:1111", nil).Code != http.StatusOK {
+			t.Error("期望第一个 IP 的请求被放行")
+		}
+		if request(byIP, "10.0.0.1:2222", nil).Code != http.StatusTooManyRequests {
+			t.Error("期望同一个 IP 不同端口的请求共享额度")
+		}
+		if request(byIP, "10.0.0.2:1111", nil).Code != http.StatusOK {
+			t.Error("期望不同 IP 的请求互不影响")
+		}
+
+		byKey := RateLimit(RateLimitConfig{Limit: 1, Per: time.Minute, Burst: 1, KeyFunc: KeyByHeader("X-API-Key")}, ok)
+		byKey.limiter.now = newFakeClock().Now
+		if request(byKey, "10.0.0.1:1111", map[string]string{"X-API-Key": "a"}).Code != http.StatusOK {
+			t.Error("期望 key a 的请求被放行")
+		}
+		if request(byKey, "10.0.0.1:1111", map[string]string{"X-API-Key": "b"}).Code != http.StatusOK {
+			t.Error("期望同一个 IP 上不同 API key 的请求互不影响")
+		}
+		if request(byKey, "10.0.0.2:1111", map[string]string{"X-API-Key": "a"}).Code != http.StatusTooManyRequests {
+			t.Error("期望同一个 API key 在不同 IP 上共享额度")
+		}
+	})
+
+	t.Run("按路由配置", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/login", RateLimit(RateLimitConfig{Limit: 1, Per: time.Minute, Burst: 1}, ok))
+		mux.Handle("/api/", RateLimit(RateLimitConfig{Limit: 100, Per: time.Second, Burst: 10}, ok))
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		count := func(path string, n int) (passed int) {
+			for i := 0; i < n; i++ {
+				resp, err := http.Get(srv.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					passed++
+				}
+			}
+			return passed
+		}
+		if n := count("/login", 3); n != 1 {
+			t.Errorf("期望 /login 放行 1 个请求，实际 %d 个", n)
+		}
+		if n := count("/api/orders", 5); n != 5 {
+			t.Errorf("期望 /api/ 放行 5 个请求，实际 %d 个", n)
+		}
+	})
+
+	t.Run("并发请求", func(t *testing.T) {
+		var served int32
+		var mu sync.Mutex
+		h := RateLimit(RateLimitConfig{Limit: 1, Per: time.Hour, Burst: 50}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			served++
+			mu.Unlock()
+		}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					request(h, "10.0.0.1:1234", nil)
+				}
+			}()
+		}
+		wg.Wait()
+		if served != 50 {
+			t.Errorf("期望放行 50 个请求，实际 %d 个", served)
+		}
+	})
+}
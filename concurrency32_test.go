@@ -0,0 +1,361 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 在concurrency6中RateLimiter6的基础上实现自适应的并发限制：不再手动指定maxConcurrent，
+// 而是根据下游返回的延迟和失败情况自动调整，找到下游能承受的并发数
+// 使用方式和RateLimiter6一样先Acquire一个槽位，只是Release时需要带上这次请求的结果：
+// if rl.Acquire(ctx) {
+//     start := time.Now()
+//     err := callDownstream()
+//     rl.Release(Sample{Latency: time.Since(start), Dropped: err != nil})
+// }
+//
+// RateLimiter6用带缓冲的channel作为令牌，容量创建后无法修改，所以这里用互斥锁维护在途请求数，
+// 等待的请求按FIFO顺序排队，限制变大或者有请求释放时依次唤醒
+
+// Sample 是一次请求的结果，Dropped表示请求失败、超时或者被下游拒绝
+type Sample struct {
+	Latency time.Duration
+	Dropped bool
+}
+
+// AdaptiveAlgorithm 根据一次请求的结果计算新的并发限制，inflight是释放前的在途请求数（包括这次请求）
+// 限制使用浮点数，这样算法可以每个请求只调整一个小的步长，每轮（约limit个请求）累计调整1左右
+type AdaptiveAlgorithm interface {
+	update(limit float64, inflight int, s Sample) float64
+}
+
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	alg      AdaptiveAlgorithm
+	limit    float64
+	min, max float64
+	inflight int
+	waiters  *list.List // 元素是chan struct{}，获得槽位时关闭
+}
+
+// NewAdaptiveLimiter 创建自适应并发限制器，限制从initial开始，始终保持在[min, max]之间
+// 和NewDynamicWorkPool一样，min小于1时按1处理，max小于min时按min处理，initial超出范围时取最近的边界
+func NewAdaptiveLimiter(initial, min, max int, alg AdaptiveAlgorithm) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min {
+		initial = min
+	} else if initial > max {
+		initial = max
+	}
+	return &AdaptiveLimiter{
+		alg:     alg,
+		limit:   float64(initial),
+		min:     float64(min),
+		max:     float64(max),
+		waiters: list.New(),
+	}
+}
+
+// Acquire 阻塞直到获得一个槽位，ctx取消时返回false
+func (l *AdaptiveLimiter) Acquire(ctx context.Context) bool {
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && l.inflight < l.limitLocked() {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-ready:
+			// 取消的同时获得了槽位，归还给下一个等待者
+			l.inflight--
+			l.notifyLocked()
+		default:
+			l.waiters.Remove(elem)
+		}
+		return false
+	}
+}
+
+// TryAcquire 不等待，没有空闲槽位时返回false
+func (l *AdaptiveLimiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiters.Len() == 0 && l.inflight < l.limitLocked() {
+		l.inflight++
+		return true
+	}
+	return false
+}
+
+// Release 归还槽位，并根据这次请求的结果调整并发限制
+// 和RateLimiter6一样，没有槽位被持有时的多余Release被忽略并返回false，不会调整限制
+func (l *AdaptiveLimiter) Release(s Sample) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight == 0 {
+		return false
+	}
+	l.limit = math.Max(l.min, math.Min(l.max, l.alg.update(l.limit, l.inflight, s)))
+	l.inflight--
+	l.notifyLocked()
+	return true
+}
+
+// Limit 返回当前的并发限制
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitLocked()
+}
+
+// Inflight 返回当前的在途请求数
+func (l *AdaptiveLimiter) Inflight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
+
+func (l *AdaptiveLimiter) limitLocked() int {
+	return int(l.limit)
+}
+
+// notifyLocked 按排队顺序唤醒等待者，直到没有空闲槽位
+func (l *AdaptiveLimiter) notifyLocked() {
+	for l.waiters.Len() > 0 && l.inflight < l.limitLocked() {
+		ready := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.inflight++
+		close(ready)
+	}
+}
+
+// AIMD 加性增乘性减：请求成功时每轮限制加1，请求失败或者延迟超过timeout时限制乘以backoff
+// 只根据失败来判断过载，适合下游会明确拒绝请求（例如返回429/503）的场景
+type aimd struct {
+	timeout time.Duration
+	backoff float64
+}
+
+func NewAIMD(timeout time.Duration) AdaptiveAlgorithm {
+	return &aimd{timeout: timeout, backoff: 0.9}
+}
+
+func (a *aimd) update(limit float64, inflight int, s Sample) float64 {
+	if s.Dropped || s.Latency > a.timeout {
+		return limit * a.backoff
+	}
+	// 在途请求远小于限制时说明是调用方自己的并发不够，这时成功不能说明下游还能承受更多请求
+	if float64(inflight)*2 < limit {
+		return limit
+	}
+	return limit + 1/limit
+}
+
+// Vegas 参考TCP Vegas，用观察到的最小延迟作为无排队时的延迟，估算下游的排队长度：
+// queue = limit * (1 - minRTT/rtt)
+// 排队少于alpha时增大限制，多于beta时减小限制，能在下游开始排队、还没有失败之前就停止增长
+// 这里minRTT只取历史最小值，下游的基础延迟永久变大时不会重新探测
+type vegas struct {
+	alpha, beta float64
+	backoff     float64
+	minRTT      time.Duration
+}
+
+func NewVegas() AdaptiveAlgorithm {
+	return &vegas{alpha: 3, beta: 6, backoff: 0.9}
+}
+
+func (v *vegas) update(limit float64, inflight int, s Sample) float64 {
+	if s.Dropped {
+		return limit * v.backoff
+	}
+	if s.Latency <= 0 {
+		return limit
+	}
+	if v.minRTT == 0 || s.Latency < v.minRTT {
+		v.minRTT = s.Latency
+	}
+	queue := limit * (1 - float64(v.minRTT)/float64(s.Latency))
+	switch {
+	case queue < v.alpha:
+		if float64(inflight)*2 < limit {
+			return limit
+		}
+		return limit + 1/limit
+	case queue > v.beta:
+		return limit - 1/limit
+	default:
+		return limit
+	}
+}
+
+func TestConcurrency32(t *testing.T) {
+	// simulate 模拟一个下游服务：每轮发出当前限制允许的所有请求，下游最多同时处理capacity个请求，
+	// 超过时要么排队（延迟按比例变大），要么直接拒绝超出的请求，返回最后的并发限制
+	simulate := func(l *AdaptiveLimiter, capacity int, reject bool, rounds int) int {
+		base := 10 * time.Millisecond
+		for round := 0; round < rounds; round++ {
+			n := 0
+			for l.TryAcquire() {
+				n++
+			}
+			latency := base
+			if !reject && n > capacity {
+				latency = base * time.Duration(n) / time.Duration(capacity)
+			}
+			for i := 0; i < n; i++ {
+				l.Release(Sample{Latency: latency, Dropped: reject && i >= capacity})
+			}
+		}
+		return l.Limit()
+	}
+
+	t.Run("AIMD 收敛到下游的容量", func(t *testing.T) {
+		l := NewAdaptiveLimiter(5, 1, 100, NewAIMD(time.Second))
+		limit := simulate(l, 20, true, 200)
+		if limit < 15 || limit > 22 {
+			t.Errorf("期望并发限制收敛到 20 附近，实际 %d", limit)
+		}
+		t.Logf("AIMD 收敛到 %d", limit)
+
+		// 下游容量变小后限制随之下降
+		limit = simulate(l, 8, true, 200)
+		if limit < 6 || limit > 10 {
+			t.Errorf("期望并发限制下降到 8 附近，实际 %d", limit)
+		}
+	})
+
+	t.Run("Vegas 在下游排队时停止增长", func(t *testing.T) {
+		l := NewAdaptiveLimiter(5, 1, 100, NewVegas())
+		// 下游从不拒绝请求，只是并发超过 10 之后延迟变大，AIMD 会一直增长到 max
+		limit := simulate(l, 10, false, 200)
+		if limit < 10 || limit > 17 {
+			t.Errorf("期望并发限制收敛到 10 之上一点，实际 %d", limit)
+		}
+		t.Logf("Vegas 收敛到 %d", limit)
+
+		aimdLimiter := NewAdaptiveLimiter(5, 1, 100, NewAIMD(time.Second))
+		if limit := simulate(aimdLimiter, 10, false, 200); limit != 100 {
+			t.Errorf("期望只看失败的 AIMD 增长到 max，实际 %d", limit)
+		}
+	})
+
+	t.Run("初始限制超出范围", func(t *testing.T) {
+		for _, c := range []struct{ initial, min, max, want int }{
+			{0, 1, 10, 1},
+			{-5, 0, 10, 1},
+			{50, 2, 10, 10},
+			{5, 5, 5, 5},
+			{5, 10, 2, 10},
+		} {
+			l := NewAdaptiveLimiter(c.initial, c.min, c.max, NewAIMD(time.Second))
+			if limit := l.Limit(); limit != c.want {
+				t.Errorf("NewAdaptiveLimiter(%d, %d, %d): 期望限制 %d，实际 %d", c.initial, c.min, c.max, c.want, limit)
+			}
+		}
+
+		l := NewAdaptiveLimiter(0, 1, 10, NewAIMD(time.Second))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if !l.Acquire(ctx) {
+			t.Error("期望 initial 小于 min 时仍然可以获取槽位")
+		}
+
+		// max 小于 min 时按 min 处理，限制不会超出 [min, min]
+		l = NewAdaptiveLimiter(5, 10, 2, NewAIMD(time.Second))
+		for i := 0; i < 100; i++ {
+			l.TryAcquire()
+			l.Release(Sample{Latency: time.Millisecond})
+		}
+		if limit := l.Limit(); limit != 10 {
+			t.Errorf("期望 max < min 时限制固定为 10，实际 %d", limit)
+		}
+	})
+
+	t.Run("多余的 Release 被忽略", func(t *testing.T) {
+		l := NewAdaptiveLimiter(2, 1, 10, NewAIMD(time.Second))
+		for i := 0; i < 3; i++ {
+			if l.Release(Sample{Dropped: true}) {
+				t.Error("期望没有槽位被持有时 Release 返回 false")
+			}
+		}
+		if limit, inflight := l.Limit(), l.Inflight(); limit != 2 || inflight != 0 {
+			t.Errorf("期望限制和在途请求数不变，实际 limit=%d inflight=%d", limit, inflight)
+		}
+
+		acquired := 0
+		for l.TryAcquire() {
+			acquired++
+		}
+		if acquired != 2 {
+			t.Errorf("期望最多获得 2 个槽位，实际 %d 个", acquired)
+		}
+		if !l.Release(Sample{Latency: time.Millisecond}) {
+			t.Error("期望归还已获得的槽位成功")
+		}
+	})
+
+	t.Run("调用方并发不足时不增大限制", func(t *testing.T) {
+		l := NewAdaptiveLimiter(20, 1, 100, NewAIMD(time.Second))
+		for i := 0; i < 1000; i++ {
+			l.Acquire(context.Background())
+			l.Release(Sample{Latency: time.Millisecond})
+		}
+		if limit := l.Limit(); limit != 20 {
+			t.Errorf("期望并发限制保持 20，实际 %d", limit)
+		}
+	})
+
+	t.Run("并发 Acquire 不超过限制", func(t *testing.T) {
+		l := NewAdaptiveLimiter(4, 2, 8, NewAIMD(5*time.Millisecond))
+
+		var wg sync.WaitGroup
+		var exceeded, timedOut int32
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+				if !l.Acquire(ctx) {
+					atomic.AddInt32(&timedOut, 1)
+					return
+				}
+				if l.Inflight() > 8 {
+					atomic.AddInt32(&exceeded, 1)
+				}
+				start := time.Now()
+				time.Sleep(time.Duration(id%3) * time.Millisecond)
+				l.Release(Sample{Latency: time.Since(start), Dropped: id%10 == 0})
+			}(i)
+		}
+		wg.Wait()
+
+		if exceeded != 0 {
+			t.Errorf("在途请求数超过了最大限制 %d 次", exceeded)
+		}
+		if n := l.Inflight(); n != 0 {
+			t.Errorf("期望所有槽位都被归还，实际在途 %d 个", n)
+		}
+		t.Logf("最终并发限制 %d，超时 %d 个请求", l.Limit(), timedOut)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// 实现一个分片的并发LRU缓存：key按哈希值分到N个互相独立的LRUCache中，每个分片有自己的锁，
+// 不同分片上的Get/Put可以并行执行，避免所有goroutine竞争同一把锁
+//
+// 每个分片各自按LRU淘汰，所以淘汰的不一定是全局最久未使用的元素，总容量是每个分片容量之和
+
+type ShardedLRUCache[K comparable, V any] struct {
+	shards []*LRUCache[K, V]
+	seed   maphash.Seed
+	shift  int // 哈希值右移shift位得到分片下标
+}
+
+// NewShardedLRUCache 创建分片LRU缓存，shards向上取整为2的幂，每个分片的容量为capacity/shards向上取整
+func NewShardedLRUCache[K comparable, V any](capacity, shards int) *ShardedLRUCache[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+	n := 1 << bits.Len(uint(shards-1))
+	c := &ShardedLRUCache[K, V]{
+		shards: make([]*LRUCache[K, V], n),
+		seed:   maphash.MakeSeed(),
+		shift:  64 - bits.Len(uint(n-1)),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewLRUCache[K, V]((capacity + n - 1) / n)
+	}
+	return c
+}
+
+// shard 使用maphash计算key的哈希值，取高位作为分片下标
+func (c *ShardedLRUCache[K, V]) shard(key K) *LRUCache[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.Comparable(c.seed, key)>>c.shift]
+}
+
+func (c *ShardedLRUCache[K, V]) Get(key K) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedLRUCache[K, V]) Put(key K, value V) {
+	c.shard(key).Put(key, value)
+}
+
+// Len 返回所有分片的元素数量之和，并发修改时只是一个近似值
+func (c *ShardedLRUCache[K, V]) Len() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+// Stats 返回所有分片统计信息之和
+func (c *ShardedLRUCache[K, V]) Stats() CacheStats {
+	var total CacheStats
+	for _, shard := range c.shards {
+		s := shard.Stats()
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.Evictions += s.Evictions
+		total.Expirations += s.Expirations
+		total.Rejected += s.Rejected
+		total.Cost += s.Cost
+	}
+	return total
+}
+
+func TestConcurrency33(t *testing.T) {
+	t.Run("分片数取整为 2 的幂", func(t *testing.T) {
+		for shards, want := range map[int]int{0: 1, 1: 1, 3: 4, 16: 16, 17: 32} {
+			c := NewShardedLRUCache[int, int](100, shards)
+			if len(c.shards) != want {
+				t.Errorf("shards=%d: 期望 %d 个分片，实际 %d 个", shards, want, len(c.shards))
+			}
+		}
+	})
+
+	t.Run("key 均匀分布并且不超过容量", func(t *testing.T) {
+		c := NewShardedLRUCache[int, int](1024, 16)
+		for i := 0; i < 10000; i++ {
+			c.Put(i, i)
+		}
+		for i, shard := range c.shards {
+			if n := shard.Len(); n != 64 {
+				t.Errorf("分片 %d 期望 64 个元素，实际 %d 个", i, n)
+			}
+		}
+		// 最近写入的 key 大部分应该还在缓存中
+		hits := 0
+		for i := 10000 - 512; i < 10000; i++ {
+			if val, ok := c.Get(i); ok {
+				if val != i {
+					t.Fatalf("key %d: 期望 %d，实际 %d", i, i, val)
+				}
+				hits++
+			}
+		}
+		if hits < 400 {
+			t.Errorf("期望最近写入的 512 个 key 大部分命中，实际命中 %d 个", hits)
+		}
+	})
+
+	t.Run("并发 Get 和 Put", func(t *testing.T) {
+		c := NewShardedLRUCache[int, int](256, 8)
+
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(id)))
+				for i := 0; i < 5000; i++ {
+					key := r.Intn(1024)
+					if r.Intn(10) == 0 {
+						c.Put(key, key*2)
+					} else if val, ok := c.Get(key); ok && val != key*2 {
+						t.Errorf("key %d: 期望 %d，实际 %d", key, key*2, val)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		if n := c.Len(); n > 256 {
+			t.Errorf("期望最多 256 个元素，实际 %d 个", n)
+		}
+		if stats := c.Stats(); stats.Hits+stats.Misses == 0 || stats.Evictions == 0 {
+			t.Errorf("统计结果不符合预期: %+v", stats)
+		}
+		t.Logf("命中率 %.2f", c.Stats().HitRatio())
+	})
+}
+
+// lruCacheAPI 让基准测试可以比较单个LRUCache和ShardedLRUCache
+type lruCacheAPI interface {
+	Get(key int) (int, bool)
+	Put(key int, value int)
+}
+
+// benchmarkLRUParallel 并行执行读写，reads是读操作所占的百分比，key的范围是容量的2倍
+func benchmarkLRUParallel(b *testing.B, newCache func(capacity int) lruCacheAPI, reads int) {
+	const capacity = 4096
+	cache := newCache(capacity)
+	for i := 0; i < capacity; i++ {
+		cache.Put(i, i)
+	}
+
+	var seed int64
+	var mu sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		seed++
+		r := rand.New(rand.NewSource(seed))
+		mu.Unlock()
+		for pb.Next() {
+			key := r.Intn(capacity * 2)
+			if r.Intn(100) < reads {
+				cache.Get(key)
+			} else {
+				cache.Put(key, key)
+			}
+		}
+	})
+}
+
+// 使用 go test -bench LRUCacheParallel -cpu 1,4,8 比较不同 CPU 数量下每次操作的耗时：
+// 单个 LRUCache 所有 goroutine 竞争同一把锁，增加 CPU 之后每次操作的耗时不会下降；
+// 分片之后锁竞争被分散到各个分片，多核时每次操作的耗时随 CPU 数量下降
+// 只有 1 个 CPU 时没有真正的并行，两种实现的耗时基本相同，分片还多了一次哈希计算
+func BenchmarkLRUCacheParallel(b *testing.B) {
+	designs := []struct {
+		name     string
+		newCache func(capacity int) lruCacheAPI
+	}{
+		{"Single", func(capacity int) lruCacheAPI { return NewLRUCache[int, int](capacity) }},
+		{"Sharded16", func(capacity int) lruCacheAPI { return NewShardedLRUCache[int, int](capacity, 16) }},
+		{"Sharded64", func(capacity int) lruCacheAPI { return NewShardedLRUCache[int, int](capacity, 64) }},
+	}
+	for _, reads := range []int{90, 50} {
+		for _, d := range designs {
+			b.Run(fmt.Sprintf("%s/reads=%d%%", d.name, reads), func(b *testing.B) {
+				benchmarkLRUParallel(b, d.newCache, reads)
+			})
+		}
+	}
+}
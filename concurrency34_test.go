@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 在同一个Cache接口下实现几种不同的淘汰策略，并用记录下来的访问序列（trace）比较它们的命中率：
+// LRU：concurrency11中的LRUCache，淘汰最久未使用的元素，一次大范围扫描就会把热点数据全部冲掉
+// LFU：淘汰访问次数最少的元素，次数相同时淘汰最久未使用的；没有衰减，过去的热点会一直占着缓存
+// ARC：同时维护最近访问一次（T1）和多次（T2）的元素，以及它们被淘汰的key（B1/B2），根据在B1/B2中的命中自动调整两部分的大小
+// 2Q：第一次访问的元素先进入FIFO队列A1in，被淘汰之后只记录key（A1out），在A1out中再次访问时才进入LRU队列Am
+// W-TinyLFU：新元素先进入1%大小的LRU窗口，从窗口淘汰时和主缓存中的候选淘汰元素比较近似访问频率，频率更高的留下
+//
+// 所有实现都是并发安全的，访问频率和命中只在Get时记录，trace回放时未命中的key由调用方Put进缓存
+
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Put(key K, value V)
+	Len() int
+}
+
+var _ Cache[int, int] = (*LRUCache[int, int])(nil)
+
+// LFU
+
+type lfuEntry[K comparable, V any] struct {
+	key   K
+	value V
+	freq  int
+	elem  *list.Element
+}
+
+type LFUCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[K]*lfuEntry[K, V]
+	freqs    map[int]*list.List // 每个访问次数对应一个链表，链表内按访问时间排序，前面是最近访问的
+	minFreq  int
+}
+
+func NewLFUCache[K comparable, V any](capacity int) *LFUCache[K, V] {
+	return &LFUCache[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*lfuEntry[K, V]),
+		freqs:    make(map[int]*list.List),
+	}
+}
+
+func (c *LFUCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.touch(e)
+		return e.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *LFUCache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.value = value
+		return
+	}
+	if c.capacity <= 0 {
+		return
+	}
+	if len(c.items) >= c.capacity {
+		l := c.freqs[c.minFreq]
+		victim := l.Remove(l.Back()).(*lfuEntry[K, V])
+		if l.Len() == 0 {
+			delete(c.freqs, c.minFreq)
+		}
+		delete(c.items, victim.key)
+	}
+	e := &lfuEntry[K, V]{key: key, value: value, freq: 1}
+	e.elem = c.freqList(1).PushFront(e)
+	c.items[key] = e
+	c.minFreq = 1
+}
+
+func (c *LFUCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// touch 把元素移动到访问次数加1的链表中
+func (c *LFUCache[K, V]) touch(e *lfuEntry[K, V]) {
+	l := c.freqs[e.freq]
+	l.Remove(e.elem)
+	if l.Len() == 0 {
+		delete(c.freqs, e.freq)
+		if c.minFreq == e.freq {
+			c.minFreq++
+		}
+	}
+	e.freq++
+	e.elem = c.freqList(e.freq).PushFront(e)
+}
+
+func (c *LFUCache[K, V]) freqList(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// 带所在链表的元素，ARC、2Q和W-TinyLFU中一个元素会在几个链表之间移动
+
+type listEntry[K comparable, V any] struct {
+	key   K
+	value V
+	in    *list.List
+}
+
+// moveToFront 把元素移动到dst的头部，返回新的链表元素
+func moveToFront[K comparable, V any](items map[K]*list.Element, elem *list.Element, dst *list.List) *list.Element {
+	e := elem.Value.(*listEntry[K, V])
+	e.in.Remove(elem)
+	e.in = dst
+	elem = dst.PushFront(e)
+	items[e.key] = elem
+	return elem
+}
+
+// removeBack 删除链表尾部的元素
+func removeBack[K comparable, V any](items map[K]*list.Element, l *list.List) {
+	e := l.Remove(l.Back()).(*listEntry[K, V])
+	delete(items, e.key)
+}
+
+// ARC
+
+type ARCCache[K comparable, V any] struct {
+	mu             sync.Mutex
+	capacity       int
+	p              int        // T1的目标大小
+	t1, t2, b1, b2 *list.List // B1/B2中的元素只保留key
+	items          map[K]*list.Element
+}
+
+func NewARCCache[K comparable, V any](capacity int) *ARCCache[K, V] {
+	return &ARCCache[K, V]{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+func (c *ARCCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		if e := elem.Value.(*listEntry[K, V]); e.in == c.t1 || e.in == c.t2 {
+			moveToFront[K, V](c.items, elem, c.t2)
+			return e.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *ARCCache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*listEntry[K, V])
+		switch e.in {
+		case c.b1:
+			// 最近被淘汰的只访问过一次的元素又被访问，说明T1太小
+			c.p = min(c.capacity, c.p+max(1, c.b2.Len()/c.b1.Len()))
+			c.replace(false)
+		case c.b2:
+			c.p = max(0, c.p-max(1, c.b1.Len()/c.b2.Len()))
+			c.replace(true)
+		}
+		e.value = value
+		moveToFront[K, V](c.items, elem, c.t2)
+		return
+	}
+
+	if c.t1.Len()+c.b1.Len() == c.capacity {
+		if c.t1.Len() < c.capacity {
+			removeBack[K, V](c.items, c.b1)
+			c.replace(false)
+		} else {
+			removeBack[K, V](c.items, c.t1)
+		}
+	} else if total := c.t1.Len() + c.t2.Len() + c.b1.Len() + c.b2.Len(); total >= c.capacity {
+		if total == 2*c.capacity {
+			removeBack[K, V](c.items, c.b2)
+		}
+		c.replace(false)
+	}
+	c.items[key] = c.t1.PushFront(&listEntry[K, V]{key: key, value: value, in: c.t1})
+}
+
+func (c *ARCCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t1.Len() + c.t2.Len()
+}
+
+// replace 缓存已满时根据p从T1或T2中淘汰一个元素，key移动到对应的B1或B2中
+func (c *ARCCache[K, V]) replace(inB2 bool) {
+	if c.t1.Len()+c.t2.Len() < c.capacity {
+		return
+	}
+	src, dst := c.t2, c.b2
+	if c.t1.Len() > 0 && (c.t1.Len() > c.p || (inB2 && c.t1.Len() == c.p) || c.t2.Len() == 0) {
+		src, dst = c.t1, c.b1
+	}
+	elem := src.Back()
+	var zero V
+	elem.Value.(*listEntry[K, V]).value = zero
+	moveToFront[K, V](c.items, elem, dst)
+}
+
+// 2Q
+
+type TwoQueueCache[K comparable, V any] struct {
+	mu              sync.Mutex
+	capacity        int
+	kin, kout       int
+	a1in, a1out, am *list.List // a1in是FIFO，a1out只保留key，am是LRU
+	items           map[K]*list.Element
+}
+
+// NewTwoQueueCache 按论文的建议，A1in占容量的1/4，A1out记录容量1/2个key
+func NewTwoQueueCache[K comparable, V any](capacity int) *TwoQueueCache[K, V] {
+	return &TwoQueueCache[K, V]{
+		capacity: capacity,
+		kin:      max(1, capacity/4),
+		kout:     max(1, capacity/2),
+		a1in:     list.New(),
+		a1out:    list.New(),
+		am:       list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+func (c *TwoQueueCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*listEntry[K, V])
+		switch e.in {
+		case c.am:
+			c.am.MoveToFront(elem)
+			return e.value, true
+		case c.a1in:
+			// A1in是FIFO，命中时不改变位置，只访问过一段时间的元素在这里自然老化
+			return e.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *TwoQueueCache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*listEntry[K, V])
+		switch e.in {
+		case c.am:
+			e.value = value
+			c.am.MoveToFront(elem)
+		case c.a1in:
+			e.value = value
+		case c.a1out:
+			// 被淘汰之后又被访问，说明是热点数据，进入Am；先从A1out中删除，避免reclaim时被当作最早的key删除
+			c.a1out.Remove(elem)
+			c.reclaim()
+			c.items[key] = c.am.PushFront(&listEntry[K, V]{key: key, value: value, in: c.am})
+		}
+		return
+	}
+	c.reclaim()
+	c.items[key] = c.a1in.PushFront(&listEntry[K, V]{key: key, value: value, in: c.a1in})
+}
+
+func (c *TwoQueueCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.a1in.Len() + c.am.Len()
+}
+
+// reclaim 缓存已满时腾出一个位置：A1in超过kin时把最早进入的元素移到A1out，否则淘汰Am中最久未使用的元素
+func (c *TwoQueueCache[K, V]) reclaim() {
+	if c.a1in.Len()+c.am.Len() < c.capacity {
+		return
+	}
+	if c.a1in.Len() > c.kin || c.am.Len() == 0 {
+		elem := c.a1in.Back()
+		var zero V
+		elem.Value.(*listEntry[K, V]).value = zero
+		moveToFront[K, V](c.items, elem, c.a1out)
+		if c.a1out.Len() > c.kout {
+			removeBack[K, V](c.items, c.a1out)
+		}
+		return
+	}
+	removeBack[K, V](c.items, c.am)
+}
+
+// W-TinyLFU
+
+// countMinSketch 用4行4位计数器近似统计访问频率，所有计数器的增加次数达到resetAt时全部减半，
+// 这样过去的热点会逐渐衰减，不会像LFU一样一直占着缓存
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 1 << bits.Len(uint(max(16, capacity)-1))
+	s := &countMinSketch{mask: uint64(width - 1), resetAt: 10 * max(16, capacity)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index 用双重哈希从一个64位哈希值得到每一行的下标
+func (s *countMinSketch) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	for i := range s.rows {
+		if idx := s.index(h, i); s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(h uint64) uint8 {
+	est := uint8(15)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(h, i)])
+	}
+	return est
+}
+
+type TinyLFUCache[K comparable, V any] struct {
+	mu                           sync.Mutex
+	windowCap, mainCap, protCap  int
+	window, probation, protected *list.List // 主缓存是分段LRU：第一次进入时在probation，再次命中后进入protected
+	items                        map[K]*list.Element
+	sketch                       *countMinSketch
+	seed                         maphash.Seed
+}
+
+// NewTinyLFUCache 窗口占容量的1%，主缓存中protected占80%
+func NewTinyLFUCache[K comparable, V any](capacity int) *TinyLFUCache[K, V] {
+	windowCap := max(1, capacity/100)
+	mainCap := max(0, capacity-windowCap)
+	return &TinyLFUCache[K, V]{
+		windowCap: windowCap,
+		mainCap:   mainCap,
+		protCap:   mainCap * 8 / 10,
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		items:     make(map[K]*list.Element),
+		sketch:    newCountMinSketch(capacity),
+		seed:      maphash.MakeSeed(),
+	}
+}
+
+func (c *TinyLFUCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sketch.increment(maphash.Comparable(c.seed, key))
+	elem, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := elem.Value.(*listEntry[K, V])
+	switch e.in {
+	case c.probation:
+		moveToFront[K, V](c.items, elem, c.protected)
+		if c.protected.Len() > c.protCap {
+			moveToFront[K, V](c.items, c.protected.Back(), c.probation)
+		}
+	default:
+		e.in.MoveToFront(elem)
+	}
+	return e.value, true
+}
+
+func (c *TinyLFUCache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*listEntry[K, V]).value = value
+		return
+	}
+	c.items[key] = c.window.PushFront(&listEntry[K, V]{key: key, value: value, in: c.window})
+	if c.window.Len() <= c.windowCap {
+		return
+	}
+
+	candidate := c.window.Back()
+	if c.probation.Len()+c.protected.Len() < c.mainCap {
+		moveToFront[K, V](c.items, candidate, c.probation)
+		return
+	}
+	victim := c.probation.Back()
+	if victim == nil {
+		victim = c.protected.Back()
+	}
+	// 从窗口淘汰的元素比主缓存中最可能被淘汰的元素访问更频繁时才进入主缓存
+	if victim != nil && c.frequency(candidate) > c.frequency(victim) {
+		removeBack[K, V](c.items, victim.Value.(*listEntry[K, V]).in)
+		moveToFront[K, V](c.items, candidate, c.probation)
+		return
+	}
+	removeBack[K, V](c.items, c.window)
+}
+
+func (c *TinyLFUCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.window.Len() + c.probation.Len() + c.protected.Len()
+}
+
+func (c *TinyLFUCache[K, V]) frequency(elem *list.Element) uint8 {
+	return c.sketch.estimate(maphash.Comparable(c.seed, elem.Value.(*listEntry[K, V]).key))
+}
+
+// trace回放
+
+// ReadTrace 读取记录下来的访问序列，每个key是一个整数，用空白字符分隔，#开头的行是注释
+func ReadTrace(r io.Reader) ([]int, error) {
+	var trace []int
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(text) {
+			key, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("trace line %d: %w", line, err)
+			}
+			trace = append(trace, key)
+		}
+	}
+	return trace, scanner.Err()
+}
+
+// ReplayTrace 把访问序列依次交给缓存，未命中时写入缓存，返回命中率
+func ReplayTrace(cache Cache[int, int], trace []int) float64 {
+	if len(trace) == 0 {
+		return 0
+	}
+	hits := 0
+	for _, key := range trace {
+		if _, ok := cache.Get(key); ok {
+			hits++
+		} else {
+			cache.Put(key, key)
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+var cachePolicies = []struct {
+	name     string
+	newCache func(capacity int) Cache[int, int]
+}{
+	{"LRU", func(capacity int) Cache[int, int] { return NewLRUCache[int, int](capacity) }},
+	{"LFU", func(capacity int) Cache[int, int] { return NewLFUCache[int, int](capacity) }},
+	{"ARC", func(capacity int) Cache[int, int] { return NewARCCache[int, int](capacity) }},
+	{"2Q", func(capacity int) Cache[int, int] { return NewTwoQueueCache[int, int](capacity) }},
+	{"W-TinyLFU", func(capacity int) Cache[int, int] { return NewTinyLFUCache[int, int](capacity) }},
+}
+
+// zipfTrace 生成符合Zipf分布的访问序列，少数key被频繁访问
+func zipfTrace(r *rand.Rand, n, keys int) []int {
+	zipf := rand.NewZipf(r, 1.1, 1, uint64(keys-1))
+	trace := make([]int, n)
+	for i := range trace {
+		trace[i] = int(zipf.Uint64())
+	}
+	return trace
+}
+
+// scanTrace 在Zipf分布的访问中每隔一段时间插入一次大范围的顺序扫描，扫描的key只访问一次
+func scanTrace(r *rand.Rand, n, keys, every, scanLen int) []int {
+	trace := zipfTrace(r, n, keys)
+	out := make([]int, 0, n+n/every*scanLen)
+	next := keys
+	for i, key := range trace {
+		if i > 0 && i%every == 0 {
+			for j := 0; j < scanLen; j++ {
+				out = append(out, next)
+				next++
+			}
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// loopTrace 循环访问比缓存稍大的一组key，LRU在这种访问模式下每次都会淘汰下一个要访问的key
+func loopTrace(n, keys int) []int {
+	trace := make([]int, n)
+	for i := range trace {
+		trace[i] = i % keys
+	}
+	return trace
+}
+
+func cacheTraces(capacity int) map[string][]int {
+	r := rand.New(rand.NewSource(1))
+	return map[string][]int{
+		"zipf": zipfTrace(r, 100000, 50*capacity),
+		"scan": scanTrace(r, 100000, 50*capacity, 5000, 2*capacity),
+		"loop": loopTrace(100000, capacity*3/2),
+	}
+}
+
+func TestConcurrency34(t *testing.T) {
+	t.Run("基本的读写和容量", func(t *testing.T) {
+		for _, policy := range cachePolicies {
+			cache := policy.newCache(100)
+			for i := 0; i < 1000; i++ {
+				cache.Put(i, i*10)
+				if val, ok := cache.Get(i); ok && val != i*10 {
+					t.Errorf("%s: key %d 期望 %d，实际 %d", policy.name, i, i*10, val)
+				}
+				if n := cache.Len(); n > 100 {
+					t.Fatalf("%s: 期望最多 100 个元素，实际 %d 个", policy.name, n)
+				}
+			}
+			cache.Put(999, 1)
+			if val, ok := cache.Get(999); ok && val != 1 {
+				t.Errorf("%s: 期望覆盖后的值 1，实际 %d", policy.name, val)
+			}
+		}
+	})
+
+	t.Run("LFU 淘汰访问次数最少的元素", func(t *testing.T) {
+		cache := NewLFUCache[string, int](2)
+		cache.Put("a", 1)
+		cache.Put("b", 2)
+		cache.Get("a")
+		cache.Get("a")
+		cache.Get("b")
+		cache.Put("c", 3) // b 访问次数更少，被淘汰
+		if _, ok := cache.Get("b"); ok {
+			t.Error("期望 b 被淘汰")
+		}
+		if _, ok := cache.Get("a"); !ok {
+			t.Error("期望 a 仍然在缓存中")
+		}
+	})
+
+	t.Run("读取 trace", func(t *testing.T) {
+		trace, err := ReadTrace(strings.NewReader("# 记录的访问序列\n1 2 3\n\n2 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(trace) != "[1 2 3 2 1]" {
+			t.Errorf("期望 [1 2 3 2 1]，实际 %v", trace)
+		}
+		if _, err := ReadTrace(strings.NewReader("1\nx\n")); err == nil {
+			t.Error("期望无法解析的 key 返回错误")
+		}
+		// 容量为 2 时只有第二次访问 2 命中
+		if ratio := ReplayTrace(NewLRUCache[int, int](2), trace); ratio != 0.2 {
+			t.Errorf("期望命中率 0.2，实际 %v", ratio)
+		}
+	})
+
+	t.Run("回放 trace 比较命中率", func(t *testing.T) {
+		const capacity = 1000
+		traces := cacheTraces(capacity)
+		ratios := make(map[string]map[string]float64)
+		for _, name := range []string{"zipf", "scan", "loop"} {
+			ratios[name] = make(map[string]float64)
+			line := fmt.Sprintf("%-5s", name)
+			for _, policy := range cachePolicies {
+				ratio := ReplayTrace(policy.newCache(capacity), traces[name])
+				ratios[name][policy.name] = ratio
+				line += fmt.Sprintf("  %s=%.3f", policy.name, ratio)
+			}
+			t.Log(line)
+		}
+
+		// 扫描会把 LRU 中的热点数据冲掉，能抵抗扫描的策略命中率应该更高
+		for _, name := range []string{"ARC", "2Q", "W-TinyLFU"} {
+			if ratios["scan"][name] <= ratios["scan"]["LRU"] {
+				t.Errorf("scan: 期望 %s 的命中率高于 LRU，实际 %.3f <= %.3f", name, ratios["scan"][name], ratios["scan"]["LRU"])
+			}
+		}
+		// 循环访问比容量大的 key 时 LRU 完全不会命中；LFU 中所有 key 的访问次数相同，退化成 LRU，ARC 也无法适应这种模式
+		if ratios["loop"]["LRU"] != 0 {
+			t.Errorf("loop: 期望 LRU 命中率为 0，实际 %.3f", ratios["loop"]["LRU"])
+		}
+		for _, name := range []string{"2Q", "W-TinyLFU"} {
+			if ratios["loop"][name] < 0.3 {
+				t.Errorf("loop: 期望 %s 的命中率不低于 0.3，实际 %.3f", name, ratios["loop"][name])
+			}
+		}
+	})
+}
+
+// BenchmarkCachePolicies 回放每个 trace，除了耗时之外用 hit% 报告命中率
+func BenchmarkCachePolicies(b *testing.B) {
+	const capacity = 1000
+	traces := cacheTraces(capacity)
+	for _, name := range []string{"zipf", "scan", "loop"} {
+		for _, policy := range cachePolicies {
+			b.Run(name+"/"+policy.name, func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = ReplayTrace(policy.newCache(capacity), traces[name])
+				}
+				b.ReportMetric(ratio*100, "hit%")
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(traces[name])), "ns/access")
+			})
+		}
+	}
+}
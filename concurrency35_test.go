@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 在LRUCache的基础上实现一个读穿透（read-through）缓存：GetOrLoad未命中时调用loader从后端加载并写入缓存
+// 1. 同一个key同时只会有一个loader在执行，其他goroutine等待这次加载的结果（singleflight），避免缓存击穿
+// 2. loader返回的错误也会缓存一小段时间（负缓存），后端不存在的key不会每次都打到后端
+// 3. 元素快过期时提前在后台刷新（refresh-ahead），调用方直接拿到旧值，不需要等待加载
+//
+// loader使用context.WithoutCancel(ctx)执行，某个等待者的ctx取消不会影响其他等待同一个key的goroutine
+
+type loadCall[V any] struct {
+	done  chan struct{} // 加载完成时关闭，之后value和err不再修改
+	value V
+	err   error
+}
+
+type LoadingCache[K comparable, V any] struct {
+	cache        *LRUCache[K, V]
+	negatives    *LRUCache[K, error]
+	refreshAhead time.Duration
+	mu           sync.Mutex
+	calls        map[K]*loadCall[V]
+}
+
+// NewLoadingCache 创建读穿透缓存，加载成功的值缓存ttl，失败的错误缓存negativeTTL，negativeTTL<=0表示不缓存错误
+// refreshAhead>0时，命中的元素剩余的过期时间小于refreshAhead会在后台重新加载
+func NewLoadingCache[K comparable, V any](capacity int, ttl, negativeTTL, refreshAhead time.Duration) *LoadingCache[K, V] {
+	c := &LoadingCache[K, V]{
+		cache:        NewLRUCacheWithTTL[K, V](capacity, ttl, 0),
+		refreshAhead: refreshAhead,
+		calls:        make(map[K]*loadCall[V]),
+	}
+	if negativeTTL > 0 {
+		c.negatives = NewLRUCacheWithTTL[K, error](capacity, negativeTTL, 0)
+	}
+	return c
+}
+
+// GetOrLoad 返回key对应的值，不存在时调用loader加载；ctx只控制当前调用方的等待时间
+func (c *LoadingCache[K, V]) GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context, key K) (V, error)) (V, error) {
+	if value, expireAt, ok := c.cache.getWithExpiry(key); ok {
+		if c.refreshAhead > 0 && !expireAt.IsZero() && expireAt.Sub(c.cache.now()) < c.refreshAhead {
+			c.load(ctx, key, loader)
+		}
+		return value, nil
+	}
+	var zero V
+	if c.negatives != nil {
+		if err, ok := c.negatives.Get(key); ok {
+			return zero, err
+		}
+	}
+
+	call := c.load(ctx, key, loader)
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// load 启动key的加载，已经有加载在进行时直接返回它
+func (c *LoadingCache[K, V]) load(ctx context.Context, key K, loader func(ctx context.Context, key K) (V, error)) *loadCall[V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call
+	}
+	call := &loadCall[V]{done: make(chan struct{})}
+	c.calls[key] = call
+
+	go func() {
+		var value V
+		err := safeCall(func() (err error) {
+			value, err = loader(context.WithoutCancel(ctx), key)
+			return err
+		})
+		// 先写入缓存再删除call，之后的调用方要么等待这个call，要么直接命中缓存
+		// 后台刷新失败时旧值仍然有效，不写入负缓存，否则旧值过期之后会返回这个错误而不是重新加载
+		if err == nil {
+			c.cache.Put(key, value)
+			if c.negatives != nil {
+				c.negatives.Delete(key)
+			}
+		} else if _, ok := c.cache.Peek(key); !ok && c.negatives != nil {
+			c.negatives.Put(key, err)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+
+		call.value, call.err = value, err
+		close(call.done)
+	}()
+	return call
+}
+
+func TestConcurrency35(t *testing.T) {
+	t.Run("并发加载同一个 key 只调用一次 loader", func(t *testing.T) {
+		c := NewLoadingCache[string, string](100, time.Minute, 0, 0)
+		var calls int32
+		loader := func(ctx context.Context, key string) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(20 * time.Millisecond)
+			return "value of " + key, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				key := fmt.Sprintf("user-%d", id%2)
+				value, err := c.GetOrLoad(context.Background(), key, loader)
+				if err != nil || value != "value of "+key {
+					t.Errorf("期望 %q，实际 %q, %v", "value of "+key, value, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if calls != 2 {
+			t.Errorf("期望每个 key 只加载一次，实际加载了 %d 次", calls)
+		}
+		c.GetOrLoad(context.Background(), "user-0", loader)
+		if calls != 2 {
+			t.Error("期望加载之后直接命中缓存")
+		}
+	})
+
+	t.Run("缓存加载失败的结果", func(t *testing.T) {
+		clock := newFakeClock()
+		c := NewLoadingCache[int, string](100, time.Minute, 5*time.Second, 0)
+		c.cache.now = clock.Now
+		c.negatives.now = clock.Now
+
+		errNotFound := errors.New("not found")
+		var calls int32
+		loader := func(ctx context.Context, key int) (string, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return "", errNotFound
+			}
+			return "found", nil
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := c.GetOrLoad(context.Background(), 1, loader); !errors.Is(err, errNotFound) {
+				t.Errorf("期望返回 %v，实际 %v", errNotFound, err)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("期望错误被缓存，实际加载了 %d 次", calls)
+		}
+
+		clock.Advance(5 * time.Second)
+		if value, err := c.GetOrLoad(context.Background(), 1, loader); err != nil || value != "found" {
+			t.Errorf("期望负缓存过期后重新加载成功，实际 %q, %v", value, err)
+		}
+	})
+
+	t.Run("快过期时在后台刷新", func(t *testing.T) {
+		clock := newFakeClock()
+		c := NewLoadingCache[string, int](100, time.Minute, 0, 10*time.Second)
+		c.cache.now = clock.Now
+
+		var version int32
+		refreshed := make(chan struct{}, 1)
+		loader := func(ctx context.Context, key string) (int, error) {
+			v := atomic.AddInt32(&version, 1)
+			if v > 1 {
+				refreshed <- struct{}{}
+			}
+			return int(v), nil
+		}
+
+		c.GetOrLoad(context.Background(), "config", loader)
+		clock.Advance(45 * time.Second)
+		if value, _ := c.GetOrLoad(context.Background(), "config", loader); value != 1 || version != 1 {
+			t.Errorf("期望离过期还早时不刷新，实际 value=%d version=%d", value, version)
+		}
+
+		clock.Advance(10 * time.Second)
+		if value, _ := c.GetOrLoad(context.Background(), "config", loader); value != 1 {
+			t.Errorf("期望刷新时先返回旧值 1，实际 %d", value)
+		}
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatal("期望在后台刷新")
+		}
+		// 等待刷新的结果写入缓存
+		for i := 0; i < 100; i++ {
+			if value, _ := c.cache.Peek("config"); value == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		clock.Advance(50 * time.Second)
+		if value, _ := c.GetOrLoad(context.Background(), "config", loader); value != 2 {
+			t.Errorf("期望刷新之后的值 2 在原来的过期时间之后仍然有效，实际 %d", value)
+		}
+	})
+
+	t.Run("后台刷新失败不写入负缓存", func(t *testing.T) {
+		clock := newFakeClock()
+		c := NewLoadingCache[string, int](100, time.Minute, 30*time.Second, 10*time.Second)
+		c.cache.now = clock.Now
+		c.negatives.now = clock.Now
+
+		errBackend := errors.New("backend unavailable")
+		var calls int32
+		loader := func(ctx context.Context, key string) (int, error) {
+			if atomic.AddInt32(&calls, 1) == 2 {
+				return 0, errBackend
+			}
+			return int(calls), nil
+		}
+
+		c.GetOrLoad(context.Background(), "config", loader)
+		clock.Advance(55 * time.Second)
+		if value, err := c.GetOrLoad(context.Background(), "config", loader); value != 1 || err != nil {
+			t.Errorf("期望刷新时返回旧值 1，实际 %d, %v", value, err)
+		}
+		// 等待失败的刷新结束
+		for i := 0; i < 100; i++ {
+			c.mu.Lock()
+			n := len(c.calls)
+			c.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// 旧值过期，负缓存中没有刷新失败的错误，重新加载
+		clock.Advance(6 * time.Second)
+		if value, err := c.GetOrLoad(context.Background(), "config", loader); value != 3 || err != nil {
+			t.Errorf("期望旧值过期之后重新加载得到 3，实际 %d, %v", value, err)
+		}
+	})
+
+	t.Run("等待者取消不影响加载", func(t *testing.T) {
+		c := NewLoadingCache[string, string](100, time.Minute, 0, 0)
+		release := make(chan struct{})
+		loader := func(ctx context.Context, key string) (string, error) {
+			<-release
+			return "slow", ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := c.GetOrLoad(ctx, "k", loader); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+
+		done := make(chan string)
+		go func() {
+			value, _ := c.GetOrLoad(context.Background(), "k", loader)
+			done <- value
+		}()
+		close(release)
+		if value := <-done; value != "slow" {
+			t.Errorf("期望第一个调用方取消之后加载仍然完成，实际 %q", value)
+		}
+	})
+
+	t.Run("loader panic", func(t *testing.T) {
+		c := NewLoadingCache[int, int](100, time.Minute, 0, 0)
+		_, err := c.GetOrLoad(context.Background(), 1, func(ctx context.Context, key int) (int, error) {
+			panic("boom")
+		})
+		var pe *PanicError
+		if !errors.As(err, &pe) || pe.Value != "boom" {
+			t.Errorf("期望返回 PanicError，实际 %v", err)
+		}
+		if value, err := c.GetOrLoad(context.Background(), 1, func(ctx context.Context, key int) (int, error) {
+			return 42, nil
+		}); err != nil || value != 42 {
+			t.Errorf("期望 panic 之后可以重新加载，实际 %d, %v", value, err)
+		}
+	})
+}
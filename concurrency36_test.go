@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// 为concurrency11中的LRUCache实现持久化：服务重启前把缓存写入文件，启动时恢复，避免冷缓存把请求全部打到数据库
+// 1. Snapshot使用encoding/gob按从最近使用到最久未使用的顺序写出所有未过期的元素
+// 2. 过期时间保存为绝对时间（墙上时间），恢复时已经过期的元素直接丢弃，没有过期的元素保留剩余的有效期
+// 3. Restore遵守当前缓存的容量，放不下时保留最近使用的元素
+//
+// key和value需要能被gob编码：只有导出字段会被保存，value是接口类型时需要先调用gob.Register注册具体类型
+
+// snapshotEntry 是快照中的一个元素，gob只编码导出字段
+type snapshotEntry[K comparable, V any] struct {
+	Key      K
+	Value    V
+	Cost     int64
+	ExpireAt time.Time // 零值表示不过期
+}
+
+// Snapshot 把所有未过期的元素按从最近使用到最久未使用的顺序写入w，不改变元素的使用顺序
+// 持有读锁时只复制元素，编码和写入w在释放锁之后进行，w很慢时也不会阻塞其他读写
+func (lru *LRUCache[K, V]) Snapshot(w io.Writer) error {
+	lru.mu.RLock()
+	now := lru.now()
+	entries := make([]snapshotEntry[K, V], 0, lru.lrulist.Len())
+	for elem := lru.lrulist.Front(); elem != nil; elem = elem.Next() {
+		if entry := elem.Value.(*Entry[K, V]); !entry.expired(now) {
+			entries = append(entries, snapshotEntry[K, V]{entry.key, entry.value, entry.cost, entry.expireAt})
+		}
+	}
+	lru.mu.RUnlock()
+
+	if err := gob.NewEncoder(w).Encode(entries); err != nil {
+		return fmt.Errorf("lru snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore 从r读取Snapshot写出的快照并加入缓存
+// 快照中的元素比缓存中已有的元素旧：已经存在的key保留当前的值，恢复的元素排在已有元素之后；
+// 超过元素数量或者总成本的限制时丢弃快照中较旧的元素，已经过期的元素也会被丢弃，都不会触发onEvict
+// 快照可能来自成本规则不同的缓存，所以成本按当前缓存的规则重新计算：有Sizer时用Sizer计算，按数量限制时为1，
+// 只有按成本限制但没有Sizer时才使用快照中保存的成本
+// 读取或者解码失败时返回错误，缓存不会被修改
+func (lru *LRUCache[K, V]) Restore(r io.Reader) error {
+	var entries []snapshotEntry[K, V]
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return fmt.Errorf("lru restore: %w", err)
+	}
+	// 和PutWithTTL一样在持有锁之前调用sizer
+	for i := range entries {
+		switch {
+		case lru.sizer != nil:
+			entries[i].Cost = lru.sizer(entries[i].Key, entries[i].Value)
+		case !lru.costLimited:
+			entries[i].Cost = 1
+		}
+	}
+
+	lru.mu.Lock()
+	defer lru.unlock()
+
+	now := lru.now()
+	lru.removeExpiredLocked(now)
+	for _, e := range entries {
+		if lru.lrulist.Len() >= lru.capacity {
+			break
+		}
+		if _, ok := lru.cache[e.Key]; ok {
+			continue
+		}
+		if !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt) {
+			continue
+		}
+		// 和PutWithCost一样拒绝负数成本；成本放不下的元素跳过，后面更旧但是更小的元素仍然可以恢复
+		if e.Cost < 0 || (lru.costLimited && lru.cost+e.Cost > lru.maxCost) {
+			continue
+		}
+		entry := &Entry[K, V]{key: e.Key, value: e.Value, cost: e.Cost, index: -1}
+		lru.setExpireLocked(entry, e.ExpireAt)
+		lru.cache[e.Key] = lru.lrulist.PushBack(entry)
+		lru.cost += e.Cost
+	}
+	return nil
+}
+
+func TestConcurrency36(t *testing.T) {
+	t.Run("按使用顺序保存和恢复", func(t *testing.T) {
+		lru := NewLRUCache[string, int](10)
+		for i, key := range []string{"a", "b", "c", "d"} {
+			lru.Put(key, i)
+		}
+		lru.Get("b")
+
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+		if keys := lru.Keys(); fmt.Sprint(keys) != "[b d c a]" {
+			t.Errorf("期望 Snapshot 不改变使用顺序，实际 %v", keys)
+		}
+
+		restored := NewLRUCache[string, int](10)
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if n := restored.Len(); n != 4 {
+			t.Errorf("期望恢复 4 个元素，实际 %d 个", n)
+		}
+		if keys := restored.Keys(); fmt.Sprint(keys) != "[b d c a]" {
+			t.Errorf("期望恢复之后的使用顺序为 [b d c a]，实际 %v", keys)
+		}
+		for i, key := range []string{"a", "b", "c", "d"} {
+			if val, ok := restored.Peek(key); !ok || val != i {
+				t.Errorf("key %s: 期望 %d，实际 %d, %v", key, i, val, ok)
+			}
+		}
+	})
+
+	t.Run("容量不够时保留最近使用的元素", func(t *testing.T) {
+		lru := NewLRUCache[int, string](100)
+		for i := 0; i < 100; i++ {
+			lru.Put(i, fmt.Sprint(i))
+		}
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+
+		small := NewLRUCache[int, string](10)
+		var evicted int
+		small.SetOnEvict(func(key int, value string, reason EvictReason) { evicted++ })
+		if err := small.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if n := small.Len(); n != 10 {
+			t.Errorf("期望恢复 10 个元素，实际 %d 个", n)
+		}
+		if keys := small.Keys(); fmt.Sprint(keys) != "[99 98 97 96 95 94 93 92 91 90]" {
+			t.Errorf("期望保留最近写入的 10 个元素，实际 %v", keys)
+		}
+		if evicted != 0 || small.Stats().Evictions != 0 {
+			t.Errorf("期望恢复时丢弃的元素不算淘汰，实际回调 %d 次，统计 %+v", evicted, small.Stats())
+		}
+	})
+
+	t.Run("按墙上时间保留过期时间", func(t *testing.T) {
+		clock := newFakeClock()
+		lru := NewLRUCacheWithTTL[string, string](10, time.Minute, 0)
+		lru.now = clock.Now
+		lru.Put("session", "s1")
+		lru.PutWithTTL("token", "t1", 10*time.Second)
+		lru.PutWithTTL("config", "c1", 0)
+		lru.PutWithTTL("expired", "e1", time.Second)
+		clock.Advance(time.Second)
+
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+
+		// 重启花了 20s
+		clock.Advance(20 * time.Second)
+		restored := NewLRUCacheWithTTL[string, string](10, time.Minute, 0)
+		restored.now = clock.Now
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if n := restored.Len(); n != 2 {
+			t.Errorf("期望恢复 2 个未过期的元素，实际 %d 个", n)
+		}
+		if _, ok := restored.Peek("token"); ok {
+			t.Error("期望 token 在重启期间过期")
+		}
+
+		// session 写入之后已经过了 21s，还剩 39s
+		clock.Advance(38 * time.Second)
+		if _, ok := restored.Get("session"); !ok {
+			t.Error("期望 session 还没有过期")
+		}
+		clock.Advance(time.Second)
+		if _, ok := restored.Get("session"); ok {
+			t.Error("期望 session 在原来的过期时间过期")
+		}
+		if val, ok := restored.Get("config"); !ok || val != "c1" {
+			t.Errorf("期望不过期的元素仍然存在，实际 %q, %v", val, ok)
+		}
+	})
+
+	t.Run("已有的元素优先", func(t *testing.T) {
+		lru := NewLRUCache[string, int](10)
+		lru.Put("a", 1)
+		lru.Put("b", 1)
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+
+		restored := NewLRUCache[string, int](2)
+		restored.Put("a", 2)
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if keys := restored.Keys(); fmt.Sprint(keys) != "[a b]" {
+			t.Errorf("期望恢复的元素排在已有元素之后，实际 %v", keys)
+		}
+		if val, _ := restored.Peek("a"); val != 2 {
+			t.Errorf("期望保留已有的值 2，实际 %d", val)
+		}
+	})
+
+	t.Run("按成本限制恢复", func(t *testing.T) {
+		sizer := func(key string, value []byte) int64 { return int64(len(value)) }
+		lru := NewLRUCacheWithCost[string, []byte](100, sizer)
+		lru.Put("small", make([]byte, 10))
+		lru.Put("big", make([]byte, 60))
+		lru.Put("medium", make([]byte, 30))
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+
+		restored := NewLRUCacheWithCost[string, []byte](50, sizer)
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if n := restored.Len(); n != 2 {
+			t.Errorf("期望恢复 2 个元素，实际 %d 个", n)
+		}
+		if keys := restored.Keys(); fmt.Sprint(keys) != "[medium small]" {
+			t.Errorf("期望跳过放不下的 big，实际 %v", keys)
+		}
+		if cost := restored.Stats().Cost; cost != 40 {
+			t.Errorf("期望总成本 40，实际 %d", cost)
+		}
+	})
+
+	t.Run("按当前缓存的规则重新计算成本", func(t *testing.T) {
+		counted := NewLRUCache[string, []byte](10)
+		counted.Put("a", make([]byte, 40))
+		counted.Put("b", make([]byte, 40))
+		counted.Put("c", make([]byte, 40))
+		var buf bytes.Buffer
+		if err := counted.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+		snapshot := buf.Bytes()
+
+		sizer := func(key string, value []byte) int64 { return int64(len(value)) }
+		sized := NewLRUCacheWithCost[string, []byte](100, sizer)
+		if err := sized.Restore(bytes.NewReader(snapshot)); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if keys := sized.Keys(); fmt.Sprint(keys) != "[c b]" {
+			t.Errorf("期望按字节数只恢复最近的 2 个元素，实际 %v", keys)
+		}
+		if cost := sized.Stats().Cost; cost != 80 {
+			t.Errorf("期望总成本 80，实际 %d", cost)
+		}
+
+		// 反过来，按字节数计算成本的快照恢复到按数量限制的缓存中，每个元素的成本为 1
+		buf.Reset()
+		if err := sized.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+		recounted := NewLRUCache[string, []byte](10)
+		if err := recounted.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if cost := recounted.Stats().Cost; cost != 2 {
+			t.Errorf("期望总成本 2，实际 %d", cost)
+		}
+	})
+
+	t.Run("跳过负数成本的元素", func(t *testing.T) {
+		var buf bytes.Buffer
+		entries := []snapshotEntry[string, int]{{Key: "bad", Value: 1, Cost: -100}, {Key: "ok", Value: 2, Cost: 30}}
+		if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+			t.Fatal(err)
+		}
+		restored := NewLRUCacheWithCost[string, int](50, nil)
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatalf("恢复快照出错: %v", err)
+		}
+		if keys := restored.Keys(); fmt.Sprint(keys) != "[ok]" {
+			t.Errorf("期望跳过负数成本的元素，实际 %v", keys)
+		}
+		if cost := restored.Stats().Cost; cost != 30 {
+			t.Errorf("期望总成本 30，实际 %d", cost)
+		}
+	})
+
+	t.Run("快照损坏时不修改缓存", func(t *testing.T) {
+		lru := NewLRUCache[int, int](10)
+		for i := 0; i < 5; i++ {
+			lru.Put(i, i)
+		}
+		var buf bytes.Buffer
+		if err := lru.Snapshot(&buf); err != nil {
+			t.Fatalf("保存快照出错: %v", err)
+		}
+		truncated := bytes.NewReader(buf.Bytes()[:buf.Len()/2])
+
+		restored := NewLRUCache[int, int](10)
+		restored.Put(100, 100)
+		if err := restored.Restore(truncated); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("期望返回 %v，实际 %v", io.ErrUnexpectedEOF, err)
+		}
+		if keys := restored.Keys(); fmt.Sprint(keys) != "[100]" {
+			t.Errorf("期望缓存不被修改，实际 %v", keys)
+		}
+		if err := restored.Restore(bytes.NewReader(nil)); !errors.Is(err, io.EOF) {
+			t.Errorf("期望空快照返回 %v，实际 %v", io.EOF, err)
+		}
+	})
+}
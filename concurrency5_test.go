@@ -1,22 +1,153 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // 设计一个并发安全的限流器，限制每秒最多接收3个请求的测试用例
+// 除了阻塞的Acquire外，还支持带ctx的Wait、非阻塞的Allow/TryAcquire、一次申请多个令牌的AcquireN，
+// 以及Reserve预占令牌并告诉调用方需要等待多久；Stop之后所有获取令牌的操作都返回ErrLimiterStopped
+//
+// RateLimiter不使用ticker和后台goroutine，每次调用时根据距离上次调用经过的时间计算令牌数（见concurrency29中的tokenBucket），
+// 为每个客户端创建一个限流器时开销很小；原来基于ticker的实现保留为TickerRateLimiter，用于基准测试对比
+
+var ErrLimiterStopped = errors.New("rate limiter is stopped")
 
 type RateLimiter struct {
 	limit   int
-	tickets chan struct{}
-	ticker  *time.Ticker
-	stop    chan struct{}
+	mu      sync.Mutex
+	bucket  tokenBucket
+	stopped bool
+	stop    chan struct{} // Stop时关闭，唤醒正在等待令牌的调用方
+	now     func() time.Time
 }
 
 func NewRateLimiter(t time.Duration, limit int) *RateLimiter {
-	rl := &RateLimiter{
+	return &RateLimiter{
+		limit: limit,
+		bucket: tokenBucket{
+			rate:   float64(limit) / (time.Second * t).Seconds(),
+			burst:  float64(limit),
+			tokens: float64(limit),
+		},
+		stop: make(chan struct{}),
+		now:  time.Now,
+	}
+}
+
+// reserve 预占n个令牌，返回可以使用令牌的时间，等待时间超过maxWait时不预占
+func (rl *RateLimiter) reserve(n int, maxWait time.Duration) (time.Time, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.stopped {
+		return time.Time{}, ErrLimiterStopped
+	}
+	if n > rl.limit {
+		return time.Time{}, ErrLimitExceeded
+	}
+	now := rl.now()
+	delay, ok := rl.bucket.reserve(now, n, maxWait)
+	if !ok {
+		return time.Time{}, context.DeadlineExceeded
+	}
+	return now.Add(delay), nil
+}
+
+// cancel 归还预占但没有使用的令牌
+func (rl *RateLimiter) cancel(n int) {
+	rl.mu.Lock()
+	rl.bucket.tokens = math.Min(rl.bucket.burst, rl.bucket.tokens+float64(n))
+	rl.mu.Unlock()
+}
+
+func (rl *RateLimiter) Acquire() error {
+	return rl.Wait(context.Background())
+}
+
+// Wait 阻塞直到获得一个令牌，ctx取消时返回ctx.Err()
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	return rl.AcquireN(ctx, 1)
+}
+
+// AcquireN 获取n个令牌，n超过limit时返回ErrLimitExceeded，失败时归还已经预占的令牌
+// 在ctx的deadline之前无法获得令牌时立即返回context.DeadlineExceeded，不再空等
+func (rl *RateLimiter) AcquireN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	maxWait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(rl.now())
+	}
+	at, err := rl.reserve(n, maxWait)
+	if err != nil {
+		return err
+	}
+	delay := at.Sub(rl.now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		rl.cancel(n)
+		return ctx.Err()
+	case <-rl.stop:
+		return ErrLimiterStopped
+	}
+}
+
+// TryAcquire 不阻塞，没有可用令牌或者已经Stop时返回false
+func (rl *RateLimiter) TryAcquire() bool {
+	_, err := rl.reserve(1, 0)
+	return err == nil
+}
+
+func (rl *RateLimiter) Allow() bool {
+	return rl.TryAcquire()
+}
+
+// Reserve 预占一个令牌，返回的Reservation说明还需要等待多久才能使用这个令牌
+func (rl *RateLimiter) Reserve() *Reservation {
+	at, err := rl.reserve(1, time.Duration(math.MaxInt64))
+	return &Reservation{ok: err == nil, timeToAct: at, now: rl.now}
+}
+
+func (rl *RateLimiter) Release() {
+	rl.cancel(1)
+}
+
+func (rl *RateLimiter) Stop() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.stopped {
+		rl.stopped = true
+		close(rl.stop)
+	}
+}
+
+// TickerRateLimiter 是基于ticker定时补充令牌的实现，每个实例都有一个ticker和一个后台goroutine
+type TickerRateLimiter struct {
+	limit    int
+	tickets  chan struct{}
+	ticker   *time.Ticker
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewTickerRateLimiter(t time.Duration, limit int) *TickerRateLimiter {
+	rl := &TickerRateLimiter{
 		limit:   limit,
 		tickets: make(chan struct{}, limit),
 		ticker:  time.NewTicker(time.Second * t / time.Duration(limit)),
@@ -29,7 +160,7 @@ func NewRateLimiter(t time.Duration, limit int) *RateLimiter {
 	return rl
 }
 
-func (rl *RateLimiter) refill() {
+func (rl *TickerRateLimiter) refill() {
 	for {
 		select {
 		case <-rl.ticker.C:
@@ -42,18 +173,33 @@ func (rl *RateLimiter) refill() {
 		}
 	}
 }
-func (rl *RateLimiter) Acquire() {
-	<-rl.tickets
+func (rl *TickerRateLimiter) Acquire() error {
+	select {
+	case <-rl.tickets:
+		return nil
+	case <-rl.stop:
+		return ErrLimiterStopped
+	}
 }
-func (rl *RateLimiter) Release() {
+func (rl *TickerRateLimiter) TryAcquire() bool {
+	select {
+	case <-rl.tickets:
+		return true
+	default:
+		return false
+	}
+}
+func (rl *TickerRateLimiter) Release() {
 	select {
 	case rl.tickets <- struct{}{}:
 	default:
 	}
 }
-func (rl *RateLimiter) Stop() {
-	rl.ticker.Stop()
-	close(rl.stop)
+func (rl *TickerRateLimiter) Stop() {
+	rl.stopOnce.Do(func() {
+		rl.ticker.Stop()
+		close(rl.stop)
+	})
 }
 
 func TestConcurrency5(t *testing.T) {
@@ -73,3 +219,249 @@ func TestConcurrency5(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestConcurrency5Wait(t *testing.T) {
+	t.Run("实现 Limiter 接口", func(t *testing.T) {
+		rl := NewRateLimiter(1, 3)
+		defer rl.Stop()
+		var _ Limiter = rl
+	})
+
+	t.Run("TryAcquire 不阻塞", func(t *testing.T) {
+		rl := NewRateLimiter(1, 3)
+		defer rl.Stop()
+
+		allowed := 0
+		for i := 0; i < 5; i++ {
+			if rl.TryAcquire() {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("期望允许 3 个请求，实际 %d 个", allowed)
+		}
+	})
+
+	t.Run("Wait 在 ctx 取消时返回", func(t *testing.T) {
+		rl := NewRateLimiter(10, 1) // 每 10s 一个令牌
+		defer rl.Stop()
+		rl.Acquire()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := rl.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("deadline 之前无法获得令牌时不预占", func(t *testing.T) {
+		rl := NewRateLimiter(10, 3)
+		defer rl.Stop()
+
+		if err := rl.AcquireN(context.Background(), 2); err != nil {
+			t.Fatalf("AcquireN 失败: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := rl.AcquireN(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+		if !rl.TryAcquire() {
+			t.Error("期望失败的 AcquireN 没有占用令牌")
+		}
+	})
+
+	t.Run("等待中取消时归还令牌", func(t *testing.T) {
+		rl := NewRateLimiter(10, 3) // 每 3.3s 一个令牌，测试期间几乎不会补充
+		defer rl.Stop()
+
+		if err := rl.AcquireN(context.Background(), 2); err != nil {
+			t.Fatalf("AcquireN 失败: %v", err)
+		}
+		// 没有 deadline，AcquireN 预占 2 个令牌（其中 1 个是未来的令牌）后开始等待
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- rl.AcquireN(ctx, 2)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		if rl.TryAcquire() {
+			t.Fatal("期望等待中的 AcquireN 已经预占了剩下的令牌")
+		}
+
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Fatalf("期望返回 %v，实际 %v", context.Canceled, err)
+		}
+		if !rl.TryAcquire() {
+			t.Error("期望取消之后归还预占的令牌")
+		}
+		if rl.TryAcquire() {
+			t.Error("期望只归还预占的 2 个令牌")
+		}
+	})
+
+	t.Run("Reserve 返回等待时间", func(t *testing.T) {
+		rl := NewRateLimiter(1, 10) // 每 100ms 一个令牌
+		defer rl.Stop()
+
+		for i := 0; i < 10; i++ {
+			if r := rl.Reserve(); !r.OK() || r.Delay() != 0 {
+				t.Fatalf("期望有可用令牌，实际 delay=%v", r.Delay())
+			}
+		}
+		first, second := rl.Reserve(), rl.Reserve()
+		if first.Delay() <= 0 || first.Delay() > 100*time.Millisecond {
+			t.Errorf("期望第一个预占等待不超过 100ms，实际 %v", first.Delay())
+		}
+		if diff := second.Delay() - first.Delay(); diff < 90*time.Millisecond || diff > 110*time.Millisecond {
+			t.Errorf("期望两个预占间隔约 100ms，实际 %v", diff)
+		}
+
+		// 预占的令牌不会再放入令牌桶
+		time.Sleep(first.Delay() + 10*time.Millisecond)
+		if rl.TryAcquire() {
+			t.Error("预占的令牌被其他请求拿走了")
+		}
+	})
+
+	t.Run("Stop 之后返回错误", func(t *testing.T) {
+		rl := NewRateLimiter(10, 1)
+		rl.Acquire()
+
+		done := make(chan error)
+		go func() {
+			done <- rl.Acquire()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		rl.Stop()
+		rl.Stop()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrLimiterStopped) {
+				t.Errorf("期望返回 %v，实际 %v", ErrLimiterStopped, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Stop 之后 Acquire 仍然阻塞")
+		}
+		if err := rl.Acquire(); !errors.Is(err, ErrLimiterStopped) {
+			t.Errorf("期望返回 %v，实际 %v", ErrLimiterStopped, err)
+		}
+		if rl.TryAcquire() || rl.Reserve().OK() {
+			t.Error("期望 Stop 之后无法获得令牌")
+		}
+	})
+}
+
+func TestConcurrency5Lazy(t *testing.T) {
+	t.Run("不创建 goroutine", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+		limiters := make([]*RateLimiter, 1000)
+		for i := range limiters {
+			limiters[i] = NewRateLimiter(1, 3)
+		}
+		if diff := runtime.NumGoroutine() - before; diff > 0 {
+			t.Errorf("期望不创建 goroutine，实际新增 %d 个", diff)
+		}
+		for _, rl := range limiters {
+			rl.Stop()
+		}
+	})
+
+	t.Run("按经过的时间补充令牌", func(t *testing.T) {
+		rl := NewRateLimiter(1, 10) // 每 100ms 一个令牌
+		defer rl.Stop()
+		clock := newFakeClock()
+		rl.now = clock.Now
+
+		for rl.TryAcquire() {
+		}
+		clock.Advance(250 * time.Millisecond)
+		allowed := 0
+		for rl.TryAcquire() {
+			allowed++
+		}
+		if allowed != 2 {
+			t.Errorf("期望 250ms 后补充 2 个令牌，实际 %d 个", allowed)
+		}
+	})
+
+	t.Run("AcquireN 超过容量", func(t *testing.T) {
+		rl := NewRateLimiter(1, 3)
+		defer rl.Stop()
+		if err := rl.AcquireN(context.Background(), 4); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", ErrLimitExceeded, err)
+		}
+	})
+}
+
+// 对比为 100k 个客户端各创建一个限流器（每分钟 60 个请求）时两种实现的内存开销和 CPU 开销
+// go test -run '^$' -bench RateLimiter100k
+const benchLimiters = 100_000
+
+type benchLimiter interface {
+	TryAcquire() bool
+	Stop()
+}
+
+func benchmarkLimiterDesigns(b *testing.B, fn func(b *testing.B, newLimiter func() benchLimiter)) {
+	b.Run("lazy", func(b *testing.B) {
+		fn(b, func() benchLimiter { return NewRateLimiter(60, 60) })
+	})
+	b.Run("ticker", func(b *testing.B) {
+		fn(b, func() benchLimiter { return NewTickerRateLimiter(60, 60) })
+	})
+}
+
+func BenchmarkRateLimiter100kMemory(b *testing.B) {
+	benchmarkLimiterDesigns(b, func(b *testing.B, newLimiter func() benchLimiter) {
+		var bytesPerLimiter, goroutines float64
+		for i := 0; i < b.N; i++ {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			g := runtime.NumGoroutine()
+
+			limiters := make([]benchLimiter, benchLimiters)
+			for j := range limiters {
+				limiters[j] = newLimiter()
+			}
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+			bytesPerLimiter = float64(used) / benchLimiters
+			goroutines = float64(runtime.NumGoroutine() - g)
+			for _, rl := range limiters {
+				rl.Stop()
+			}
+		}
+		b.ReportMetric(bytesPerLimiter, "bytes/limiter")
+		b.ReportMetric(goroutines, "goroutines")
+	})
+}
+
+func BenchmarkRateLimiter100kAllow(b *testing.B) {
+	benchmarkLimiterDesigns(b, func(b *testing.B, newLimiter func() benchLimiter) {
+		limiters := make([]benchLimiter, benchLimiters)
+		for j := range limiters {
+			limiters[j] = newLimiter()
+		}
+		defer func() {
+			for _, rl := range limiters {
+				rl.Stop()
+			}
+		}()
+
+		// 只测量单次调用的开销：ticker 实现只是一次 channel 接收，lazy 实现需要加锁和读取时间，两者接近；
+		// 没有请求时后台 goroutine 消耗的 CPU 由 BenchmarkRateLimiter100kIdleCPU 测量
+		var next atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				limiters[next.Add(1)%benchLimiters].TryAcquire()
+			}
+		})
+	})
+}
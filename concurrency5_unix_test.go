@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processCPUTime 返回进程到目前为止消耗的用户态和内核态CPU时间
+func processCPUTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatalf("getrusage: %v", err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// 100k 个限流器创建之后不调用任何方法，统计空闲的 idleWindow 内进程消耗的 CPU 时间：
+// lazy 实现没有后台工作，CPU 时间接近 0；ticker 实现每个限流器每秒被唤醒一次（每分钟 60 个请求），
+// 100k 个 goroutine 和 timer 即使没有请求也在持续消耗 CPU
+// go test -run '^$' -bench RateLimiter100kIdleCPU
+func BenchmarkRateLimiter100kIdleCPU(b *testing.B) {
+	const idleWindow = 2 * time.Second
+	benchmarkLimiterDesigns(b, func(b *testing.B, newLimiter func() benchLimiter) {
+		var cpu time.Duration
+		for i := 0; i < b.N; i++ {
+			limiters := make([]benchLimiter, benchLimiters)
+			for j := range limiters {
+				limiters[j] = newLimiter()
+			}
+
+			before := processCPUTime(b)
+			time.Sleep(idleWindow)
+			cpu += processCPUTime(b) - before
+
+			for _, rl := range limiters {
+				rl.Stop()
+			}
+		}
+		b.ReportMetric(float64(cpu.Milliseconds())/float64(b.N)/idleWindow.Seconds(), "cpu-ms/s")
+	})
+}
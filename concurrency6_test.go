@@ -2,39 +2,141 @@ package main
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // 设计一个限流器，同一时间最多允许5个并发请求的测试用例
+//
+// Stop之后Acquire返回ErrLimiterStopped，已经获得的槽位仍然可以Release，Drain在Stop之后等待所有槽位被归还
+// 令牌channel在Stop时不关闭，否则Stop之后的Release会向已关闭的channel发送数据而panic，Acquire也会从已关闭的channel立即成功
+//
+// held记录已经获得还没有归还的槽位数，Release只在held大于0时归还令牌，保证channel中的令牌数加上held始终等于maxConcurrent
+// 但Release不知道调用方是谁：有槽位被持有时，多余的Release会归还别人的槽位，同时运行的请求仍然可能超过maxConcurrent
+// 需要严格保证上限时使用AcquirePermit，每个Permit只能归还一次，重复调用Permit.Release会被忽略
 
 type RateLimiter6 struct {
-	ch chan struct{}
+	ch        chan struct{}
+	done      chan struct{} // Stop时关闭
+	stopOnce  sync.Once
+	drained   chan struct{} // Stop之后所有槽位都被归还时关闭
+	drainOnce sync.Once
+	held      atomic.Int32
 }
 
 func NewRateLimiter6(maxConcurrent int) *RateLimiter6 {
 	rl := &RateLimiter6{
-		ch: make(chan struct{}, maxConcurrent),
+		ch:      make(chan struct{}, maxConcurrent),
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
 	}
 	for i := 0; i < maxConcurrent; i++ {
 		rl.ch <- struct{}{}
 	}
 	return rl
 }
+
+// Stop 停止限流器，之后的Acquire都返回ErrLimiterStopped，重复调用是安全的
 func (rl *RateLimiter6) Stop() {
-	close(rl.ch)
+	rl.stopOnce.Do(func() {
+		close(rl.done)
+	})
+	rl.checkDrained()
 }
-func (rl *RateLimiter6) Acquire(ctx context.Context) bool { // 引入超时机制，防止大量请求阻塞
+
+// Drain 停止限流器并等待所有已获得的槽位被归还，ctx先结束时返回ctx.Err()
+func (rl *RateLimiter6) Drain(ctx context.Context) error {
+	rl.Stop()
+	select {
+	case <-rl.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rl *RateLimiter6) Acquire(ctx context.Context) error { // 引入超时机制，防止大量请求阻塞
+	select {
+	case <-rl.done:
+		return ErrLimiterStopped
+	default:
+	}
 	select {
 	case <-rl.ch:
-		return true
+		// select在多个case就绪时随机选择，Stop之后仍然可能拿到令牌，这时放回去
+		select {
+		case <-rl.done:
+			rl.put()
+			return ErrLimiterStopped
+		default:
+			rl.held.Add(1)
+			return nil
+		}
+	case <-rl.done:
+		return ErrLimiterStopped
 	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release 归还槽位，Stop之后也可以调用；没有槽位被持有时的多余Release会被忽略，返回false
+func (rl *RateLimiter6) Release() bool {
+	for {
+		held := rl.held.Load()
+		if held <= 0 {
+			return false
+		}
+		if rl.held.CompareAndSwap(held, held-1) {
+			break
+		}
+	}
+	rl.put()
+	return true
+}
+
+// Permit 表示AcquirePermit获得的一个槽位
+type Permit struct {
+	rl       *RateLimiter6
+	released atomic.Bool
+}
+
+// AcquirePermit 和Acquire一样获取槽位，返回的Permit只能归还一次
+func (rl *RateLimiter6) AcquirePermit(ctx context.Context) (*Permit, error) {
+	if err := rl.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	return &Permit{rl: rl}, nil
+}
+
+// Release 归还槽位，只有第一次调用有效，之后返回false
+func (p *Permit) Release() bool {
+	if !p.released.CompareAndSwap(false, true) {
 		return false
 	}
+	return p.rl.Release()
 }
-func (rl *RateLimiter6) Release() {
+
+// put 把令牌放回channel，调用方保证令牌是从channel中取出的，所以不会阻塞
+func (rl *RateLimiter6) put() {
 	rl.ch <- struct{}{}
+	rl.checkDrained()
+}
+
+// checkDrained 在Stop之后所有令牌都回到channel中时通知Drain
+func (rl *RateLimiter6) checkDrained() {
+	select {
+	case <-rl.done:
+	default:
+		return
+	}
+	if len(rl.ch) == cap(rl.ch) {
+		rl.drainOnce.Do(func() {
+			close(rl.drained)
+		})
+	}
 }
 
 func TestConcurrency6(t *testing.T) {
@@ -47,7 +149,7 @@ func TestConcurrency6(t *testing.T) {
 		defer cancel()
 		go func(id int, rl *RateLimiter6, ctx context.Context) {
 			defer wg.Done()
-			if rl.Acquire(ctx) {
+			if rl.Acquire(ctx) == nil {
 				t.Logf("Request %d is being processed", id)
 				time.Sleep(20 * time.Millisecond)
 				rl.Release()
@@ -58,3 +160,208 @@ func TestConcurrency6(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestConcurrency6Stop(t *testing.T) {
+	t.Run("Stop 之后拒绝 Acquire", func(t *testing.T) {
+		rl := NewRateLimiter6(2)
+		rl.Stop()
+		rl.Stop()
+		if err := rl.Acquire(context.Background()); !errors.Is(err, ErrLimiterStopped) {
+			t.Errorf("期望返回 %v，实际 %v", ErrLimiterStopped, err)
+		}
+	})
+
+	t.Run("Stop 唤醒阻塞的 Acquire", func(t *testing.T) {
+		rl := NewRateLimiter6(1)
+		if err := rl.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- rl.Acquire(context.Background())
+		}()
+		time.Sleep(10 * time.Millisecond)
+		rl.Stop()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrLimiterStopped) {
+				t.Errorf("期望返回 %v，实际 %v", ErrLimiterStopped, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Stop 之后 Acquire 仍然阻塞")
+		}
+	})
+
+	t.Run("超时返回 ctx 的错误", func(t *testing.T) {
+		rl := NewRateLimiter6(1)
+		defer rl.Stop()
+		rl.Acquire(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := rl.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("Stop 之后 Release 不会 panic", func(t *testing.T) {
+		rl := NewRateLimiter6(2)
+		rl.Acquire(context.Background())
+		rl.Stop()
+		if !rl.Release() {
+			t.Error("期望归还已获得的槽位成功")
+		}
+		// 没有对应 Acquire 的 Release 被忽略
+		if rl.Release() || rl.Release() {
+			t.Error("期望多余的 Release 返回 false")
+		}
+	})
+
+	t.Run("没有槽位被持有时忽略 Release", func(t *testing.T) {
+		rl := NewRateLimiter6(2)
+		defer rl.Stop()
+		if rl.Release() {
+			t.Error("期望没有槽位被持有时 Release 返回 false")
+		}
+		if err := rl.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !rl.Release() || rl.Release() {
+			t.Error("期望只有第一次 Release 成功")
+		}
+		if held := rl.held.Load(); held != 0 || len(rl.ch) != 2 {
+			t.Errorf("期望令牌全部归还并且不多出令牌，实际 held=%d tokens=%d", held, len(rl.ch))
+		}
+	})
+
+	t.Run("重复归还 Permit 不会超过并发上限", func(t *testing.T) {
+		const maxConcurrent = 2
+		rl := NewRateLimiter6(maxConcurrent)
+		defer rl.Stop()
+
+		var wg sync.WaitGroup
+		var active, exceeded int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+					p, err := rl.AcquirePermit(ctx)
+					cancel()
+					if err != nil {
+						continue
+					}
+					if atomic.AddInt32(&active, 1) > maxConcurrent {
+						atomic.AddInt32(&exceeded, 1)
+					}
+					time.Sleep(100 * time.Microsecond)
+					atomic.AddInt32(&active, -1)
+					p.Release()
+					p.Release() // 重复归还被忽略
+				}
+			}()
+		}
+		wg.Wait()
+		if exceeded != 0 {
+			t.Errorf("同时持有的槽位超过上限 %d 次", exceeded)
+		}
+
+		p, _ := rl.AcquirePermit(context.Background())
+		p.Release()
+		if p.Release() {
+			t.Error("期望重复归还 Permit 返回 false")
+		}
+		if n := len(rl.ch); n != maxConcurrent {
+			t.Errorf("期望令牌数保持 %d，实际 %d", maxConcurrent, n)
+		}
+	})
+
+	t.Run("Drain 等待槽位归还", func(t *testing.T) {
+		rl := NewRateLimiter6(3)
+		for i := 0; i < 3; i++ {
+			rl.Acquire(context.Background())
+		}
+
+		var released int32
+		for i := 0; i < 3; i++ {
+			go func(id int) {
+				time.Sleep(time.Duration(id+1) * 10 * time.Millisecond)
+				atomic.AddInt32(&released, 1)
+				rl.Release()
+			}(i)
+		}
+		if err := rl.Drain(context.Background()); err != nil {
+			t.Fatalf("期望 Drain 成功，实际返回 %v", err)
+		}
+		if n := atomic.LoadInt32(&released); n != 3 {
+			t.Errorf("Drain 在所有槽位归还之前返回，已归还 %d 个", n)
+		}
+		if err := rl.Drain(context.Background()); err != nil {
+			t.Errorf("期望重复 Drain 立即成功，实际返回 %v", err)
+		}
+	})
+
+	t.Run("Drain 超时", func(t *testing.T) {
+		rl := NewRateLimiter6(2)
+		rl.Acquire(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := rl.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("期望返回 %v，实际 %v", context.DeadlineExceeded, err)
+		}
+		if err := rl.Acquire(context.Background()); !errors.Is(err, ErrLimiterStopped) {
+			t.Errorf("期望 Drain 之后拒绝 Acquire，实际返回 %v", err)
+		}
+	})
+
+	t.Run("并发 Acquire/Release/Stop", func(t *testing.T) {
+		for round := 0; round < 20; round++ {
+			const maxConcurrent = 4
+			rl := NewRateLimiter6(maxConcurrent)
+
+			var wg sync.WaitGroup
+			var active, exceeded int32
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+						err := rl.Acquire(ctx)
+						cancel()
+						if errors.Is(err, ErrLimiterStopped) {
+							return
+						}
+						if err != nil {
+							continue
+						}
+						if atomic.AddInt32(&active, 1) > maxConcurrent {
+							atomic.AddInt32(&exceeded, 1)
+						}
+						time.Sleep(100 * time.Microsecond)
+						atomic.AddInt32(&active, -1)
+						rl.Release()
+					}
+				}()
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err := rl.Drain(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("第 %d 轮：期望 Drain 成功，实际返回 %v", round, err)
+			}
+			if n := atomic.LoadInt32(&active); n != 0 {
+				t.Fatalf("第 %d 轮：Drain 返回时仍有 %d 个槽位未归还", round, n)
+			}
+			wg.Wait()
+			if exceeded != 0 {
+				t.Fatalf("第 %d 轮：并发数超过限制 %d 次", round, exceeded)
+			}
+		}
+	})
+}